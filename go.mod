@@ -2,4 +2,8 @@ module go.seankhliao.com/vanity
 
 go 1.14
 
-require k8s.io/klog/v2 v2.3.0
+require (
+	golang.org/x/crypto v0.9.0
+	golang.org/x/mod v0.10.0
+	k8s.io/klog/v2 v2.3.0
+)
@@ -0,0 +1,216 @@
+package gitrepo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// Repo is a local git repository, bare or with a worktree
+type Repo struct {
+	Dir string
+}
+
+// Open checks that dir is a git repository
+func Open(ctx context.Context, dir string) (*Repo, error) {
+	r := &Repo{Dir: dir}
+	_, err := r.git(ctx, "rev-parse", "--git-dir")
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Repo) git(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	// never wait on a credentials prompt
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("git %s in %s: %w: %s", strings.Join(args, " "), r.Dir, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Mirror creates a bare mirror clone of the repository at url in dir.
+// dir only appears once the clone is complete.
+func Mirror(ctx context.Context, url, dir string) (*Repo, error) {
+	parent := filepath.Dir(dir)
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(parent, ".clone-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	_, err = (&Repo{Dir: parent}).git(ctx, "clone", "--quiet", "--mirror", "--end-of-options", url, tmp)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Repo{Dir: dir}, nil
+}
+
+// Fetch updates a mirror clone from its origin
+func (r *Repo) Fetch(ctx context.Context) error {
+	_, err := r.git(ctx, "remote", "update", "--prune")
+	return err
+}
+
+// ErrNotExist is returned when a file doesn't exist at a revision
+var ErrNotExist = errors.New("file does not exist")
+
+// ReadFile reads the contents of a file at a revision
+func (r *Repo) ReadFile(ctx context.Context, rev, file string) ([]byte, error) {
+	b, err := r.git(ctx, "ls-tree", "--name-only", rev, "--", file)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, fmt.Errorf("%s at %s: %w", file, rev, ErrNotExist)
+	}
+	return r.git(ctx, "cat-file", "blob", rev+":"+file)
+}
+
+// Archive creates a zip archive of the tree at a revision,
+// limited to subdir if it isn't empty
+func (r *Repo) Archive(ctx context.Context, rev, subdir string) ([]byte, error) {
+	// match the go command in normalizing line endings
+	args := []string{"-c", "core.autocrlf=input", "-c", "core.eol=lf", "archive", "--format=zip", rev}
+	if subdir != "" {
+		args = append(args, subdir)
+	}
+	return r.git(ctx, args...)
+}
+
+// ErrUnknownRevision is returned when a revision can't be resolved to a commit
+var ErrUnknownRevision = errors.New("unknown revision")
+
+// Commit is a resolved revision
+type Commit struct {
+	Hash string
+	// Time is the commit time
+	Time time.Time
+}
+
+// Resolve finds the commit for a revision: a branch, tag or (short) hash
+func (r *Repo) Resolve(ctx context.Context, rev string) (Commit, error) {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return Commit{}, fmt.Errorf("%q: %w", rev, ErrUnknownRevision)
+	}
+	b, err := r.git(ctx, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return Commit{}, fmt.Errorf("%q: %w", rev, ErrUnknownRevision)
+		}
+		return Commit{}, err
+	}
+	hash := strings.TrimSpace(string(b))
+	b, err = r.git(ctx, "show", "--no-patch", "--format=%ct", hash)
+	if err != nil {
+		return Commit{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return Commit{}, fmt.Errorf("parse time of %s: %w", hash, err)
+	}
+	return Commit{
+		Hash: hash,
+		Time: time.Unix(sec, 0).UTC(),
+	}, nil
+}
+
+// Tag is a git tag
+type Tag struct {
+	Name string
+	// Hash is the commit the tag points to
+	Hash string
+	// Time is the commit time
+	Time time.Time
+}
+
+// Tags lists all the tags in the repository
+func (r *Repo) Tags(ctx context.Context) ([]Tag, error) {
+	return r.tags(ctx)
+}
+
+// TagsMerged lists the tags reachable from a commit
+func (r *Repo) TagsMerged(ctx context.Context, hash string) ([]Tag, error) {
+	return r.tags(ctx, "--merged="+hash)
+}
+
+func (r *Repo) tags(ctx context.Context, args ...string) ([]Tag, error) {
+	// annotated tags need to be dereferenced to get to the commit
+	args = append([]string{"for-each-ref",
+		"--format=%(refname:strip=2)%00%(objectname)%00%(committerdate:unix)%00%(*objectname)%00%(*committerdate:unix)",
+	}, args...)
+	b, err := r.git(ctx, append(args, "refs/tags")...)
+	if err != nil {
+		return nil, err
+	}
+	var tags []Tag
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Split(line, "\x00")
+		if len(f) != 5 {
+			continue
+		}
+		if f[3] != "" {
+			f[1], f[2] = f[3], f[4]
+		}
+		if f[2] == "" {
+			continue // not pointing to a commit
+		}
+		sec, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse time of tag %s: %w", f[0], err)
+		}
+		tags = append(tags, Tag{
+			Name: f[0],
+			Hash: f[1],
+			Time: time.Unix(sec, 0).UTC(),
+		})
+	}
+	return tags, nil
+}
+
+// Versions filters tags for canonical semver versions under prefix,
+// sorted from lowest to highest.
+// The prefix, used by modules in subdirectories, is removed from the names.
+func Versions(tags []Tag, prefix string) []Tag {
+	var vs []Tag
+	for _, t := range tags {
+		if !strings.HasPrefix(t.Name, prefix) {
+			continue
+		}
+		t.Name = strings.TrimPrefix(t.Name, prefix)
+		if !semver.IsValid(t.Name) || semver.Canonical(t.Name) != t.Name {
+			continue
+		}
+		vs = append(vs, t)
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return semver.Compare(vs[i].Name, vs[j].Name) < 0
+	})
+	return vs
+}
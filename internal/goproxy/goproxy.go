@@ -0,0 +1,206 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"go.seankhliao.com/vanity/internal/modzip"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"k8s.io/klog/v2"
+)
+
+// Module is a module served from a local git repository
+type Module struct {
+	Path string
+	// Subdir is the directory in Repo holding the module,
+	// also the prefix of its version tags
+	Subdir string
+	Repo   *gitrepo.Repo
+}
+
+// Info is the response for .info and @latest
+type Info struct {
+	Version string
+	Time    time.Time
+}
+
+// Split splits a url path into an escaped module path
+// and a module proxy protocol request, eg /@v/list.
+// ok is false if it isn't a proxy request.
+func Split(p string) (modPath, req string, ok bool) {
+	p = strings.TrimPrefix(p, "/")
+	if strings.HasSuffix(p, "/@latest") {
+		return strings.TrimSuffix(p, "/@latest"), "/@latest", true
+	}
+	i := strings.Index(p, "/@v/")
+	if i < 0 {
+		return "", "", false
+	}
+	return p[:i], p[i:], true
+}
+
+// Serve handles a module proxy protocol request from Split
+func Serve(w http.ResponseWriter, r *http.Request, m Module, req string) {
+	ctx := r.Context()
+	if req == "/@latest" {
+		v, ok, err := m.latest(ctx)
+		if err != nil {
+			klog.ErrorS(err, "latest version", "module", m.Path)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "no versions", http.StatusNotFound)
+			return
+		}
+		serveInfo(w, v)
+		return
+	}
+
+	req = strings.TrimPrefix(req, "/@v/")
+	if req == "list" {
+		m.serveList(ctx, w)
+		return
+	}
+	ext := path.Ext(req)
+	q, err := module.UnescapeVersion(strings.TrimSuffix(req, ext))
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	var v version
+	var ok bool
+	switch ext {
+	case ".info":
+		// info also resolves branches and commits
+		v, ok, err = m.stat(ctx, q)
+	case ".mod", ".zip":
+		v, ok, err = m.lookup(ctx, q)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "find version", "module", m.Path, "query", q)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "unknown revision "+q, http.StatusNotFound)
+		return
+	}
+
+	switch ext {
+	case ".info":
+		serveInfo(w, v)
+	case ".mod":
+		m.serveMod(ctx, w, v)
+	case ".zip":
+		m.serveZip(ctx, w, v)
+	}
+}
+
+func (m Module) serveList(ctx context.Context, w http.ResponseWriter) {
+	vs, err := m.versions(ctx)
+	if err != nil {
+		klog.ErrorS(err, "list versions", "module", m.Path)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, v := range vs {
+		fmt.Fprintln(w, v.Version)
+	}
+}
+
+func serveInfo(w http.ResponseWriter, v version) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Info{
+		Version: v.Version,
+		Time:    v.Time,
+	})
+}
+
+func (m Module) serveMod(ctx context.Context, w http.ResponseWriter, v version) {
+	b, err := m.goMod(ctx, v)
+	if err != nil {
+		klog.ErrorS(err, "read go.mod", "module", m.Path, "version", v.Version)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b)
+}
+
+func (m Module) serveZip(ctx context.Context, w http.ResponseWriter, v version) {
+	b, err := m.zip(ctx, v)
+	if err != nil {
+		klog.ErrorS(err, "create zip", "module", m.Path, "version", v.Version)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(b)
+}
+
+func (m Module) goMod(ctx context.Context, v version) ([]byte, error) {
+	b, err := m.Repo.ReadFile(ctx, v.Hash, path.Join(m.Subdir, "go.mod"))
+	if errors.Is(err, gitrepo.ErrNotExist) {
+		// modules without a go.mod get a synthesized one
+		return []byte("module " + modfile.AutoQuote(m.Path) + "\n"), nil
+	}
+	return b, err
+}
+
+func (m Module) zip(ctx context.Context, v version) ([]byte, error) {
+	var buf bytes.Buffer
+	err := modzip.Create(ctx, &buf, m.Repo, module.Version{Path: m.Path, Version: v.Version}, v.Hash, m.Subdir)
+	return buf.Bytes(), err
+}
+
+// Versions lists the tagged versions of the module
+func (m Module) Versions(ctx context.Context) ([]string, error) {
+	vs, err := m.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(vs))
+	for _, v := range vs {
+		list = append(list, v.Version)
+	}
+	return list, nil
+}
+
+// GoSum produces the go.sum lines for a canonical version of the module,
+// ok is false if the version doesn't exist
+func (m Module) GoSum(ctx context.Context, version string) (lines []byte, ok bool, err error) {
+	v, ok, err := m.lookup(ctx, version)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	zb, err := m.zip(ctx, v)
+	if err != nil {
+		return nil, false, fmt.Errorf("create zip: %w", err)
+	}
+	zh, err := modzip.Hash(zb)
+	if err != nil {
+		return nil, false, fmt.Errorf("hash zip: %w", err)
+	}
+	mb, err := m.goMod(ctx, v)
+	if err != nil {
+		return nil, false, fmt.Errorf("read go.mod: %w", err)
+	}
+	mh, err := modzip.HashMod(mb)
+	if err != nil {
+		return nil, false, fmt.Errorf("hash go.mod: %w", err)
+	}
+	return []byte(fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", m.Path, v.Version, zh, m.Path, v.Version, mh)), true, nil
+}
@@ -0,0 +1,127 @@
+package goproxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"k8s.io/klog/v2"
+)
+
+// Listings keeps the release listings of modules in memory,
+// so pages can show versions without running git on every request.
+// Listings only depend on tags, which are checked every interval,
+// and are rebuilt when they change.
+type Listings struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	mods map[string]*listing // by module path
+}
+
+type listing struct {
+	path, subdir, dir string
+
+	// tags is what the listing was built from
+	tags string
+	l    Listing
+	// ok is set once a listing was built
+	ok bool
+}
+
+// NewListings creates listings refreshed every interval once Run
+func NewListings(interval time.Duration) *Listings {
+	return &Listings{
+		interval: interval,
+		mods:     make(map[string]*listing),
+	}
+}
+
+// Add registers a module in subdir of the git repository in dir
+func (ls *Listings) Add(p, subdir, dir string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.mods[p] = &listing{path: p, subdir: subdir, dir: dir}
+}
+
+// Get returns the latest listing of a module,
+// ok is false if there isn't one (yet)
+func (ls *Listings) Get(p string) (Listing, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	l, found := ls.mods[p]
+	if !found {
+		return Listing{}, false
+	}
+	return l.l, l.ok
+}
+
+// Run refreshes the listings every interval, until ctx is done
+func (ls *Listings) Run(ctx context.Context) {
+	t := time.NewTicker(ls.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ls.Refresh(ctx)
+	}
+}
+
+// Refresh rebuilds the listings of modules with changed tags
+func (ls *Listings) Refresh(ctx context.Context) {
+	ls.mu.Lock()
+	mods := make([]listing, 0, len(ls.mods))
+	for _, l := range ls.mods {
+		mods = append(mods, *l)
+	}
+	ls.mu.Unlock()
+
+	for _, l := range mods {
+		if ctx.Err() != nil {
+			return
+		}
+		tags, rl, changed, err := l.refresh(ctx)
+		if err != nil {
+			// keep serving the last good listing
+			klog.ErrorS(err, "list versions", "module", l.path)
+			continue
+		} else if !changed {
+			continue
+		}
+		ls.mu.Lock()
+		cur := ls.mods[l.path]
+		cur.tags, cur.l, cur.ok = tags, rl, true
+		ls.mu.Unlock()
+	}
+}
+
+// refresh builds the listing if the tags changed since the last one
+func (l listing) refresh(ctx context.Context) (string, Listing, bool, error) {
+	repo, err := gitrepo.Open(ctx, l.dir)
+	if err != nil {
+		return "", Listing{}, false, err
+	}
+	ts, err := repo.Tags(ctx)
+	if err != nil {
+		return "", Listing{}, false, err
+	}
+	var b strings.Builder
+	for _, t := range ts {
+		b.WriteString(t.Name + " " + t.Hash + "\n")
+	}
+	tags := b.String()
+	if l.ok && tags == l.tags {
+		return "", Listing{}, false, nil
+	}
+	m := Module{Path: l.path, Subdir: l.subdir, Repo: repo}
+	rl, err := m.Releases(ctx)
+	if err != nil {
+		return "", Listing{}, false, err
+	}
+	return tags, rl, true, nil
+}
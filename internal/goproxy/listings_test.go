@@ -0,0 +1,53 @@
+package goproxy
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListings(t *testing.T) {
+	f := newFixture(t)
+	c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+	f.tag("v1.0.0", c1)
+	ls := NewListings(time.Hour)
+	ls.Add("vanity.test/m", "", f.dir)
+	ctx := context.Background()
+
+	latest := func() string {
+		t.Helper()
+		l, ok := ls.Get("vanity.test/m")
+		if !ok || l.Latest == nil {
+			t.Fatalf("no listing: %v %v", l, ok)
+		}
+		return l.Latest.Version
+	}
+	if _, ok := ls.Get("vanity.test/m"); ok {
+		t.Error("listing before first refresh")
+	}
+	ls.Refresh(ctx)
+	if v := latest(); v != "v1.0.0" {
+		t.Errorf("latest = %s, want v1.0.0", v)
+	}
+
+	c2 := f.commit(map[string]string{"a.go": "package m\n"})
+	f.tag("v1.1.0", c2)
+	ls.Refresh(ctx)
+	if v := latest(); v != "v1.1.0" {
+		t.Errorf("latest after new tag = %s, want v1.1.0", v)
+	}
+
+	// the last good listing stays when the repository goes away
+	err := os.Rename(f.dir, f.dir+".moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls.Refresh(ctx)
+	if v := latest(); v != "v1.1.0" {
+		t.Errorf("latest with repository gone = %s, want v1.1.0", v)
+	}
+	if _, ok := ls.Get("vanity.test/other"); ok {
+		t.Error("listing for unknown module")
+	}
+}
@@ -0,0 +1,91 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// Listing is the released versions of a module
+type Listing struct {
+	Path string `json:"path"`
+	// Deprecated is set if the latest go.mod marks the module deprecated,
+	// with the message in Deprecation
+	Deprecated  bool   `json:"deprecated"`
+	Deprecation string `json:"deprecation,omitempty"`
+	// Latest is the highest release that isn't retracted
+	Latest *Release `json:"latest,omitempty"`
+	// LatestPrerelease is the highest prerelease that isn't retracted,
+	// if it's newer than Latest
+	LatestPrerelease *Release `json:"latest_prerelease,omitempty"`
+	// Versions are all the tagged versions, highest first
+	Versions []Release `json:"versions"`
+}
+
+// Release is a tagged version of a module
+type Release struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	// Retracted is set if the latest go.mod retracts the version
+	Retracted bool `json:"retracted"`
+	// Rationale is the comment on the retract directive
+	Rationale string `json:"rationale,omitempty"`
+}
+
+// Releases lists the tagged versions of the module.
+// Like the go command, retractions and deprecation
+// come from the go.mod of the latest version.
+func (m Module) Releases(ctx context.Context) (Listing, error) {
+	l := Listing{Path: m.Path}
+	vs, err := m.versions(ctx)
+	if err != nil {
+		return l, err
+	} else if len(vs) == 0 {
+		return l, nil
+	}
+
+	latest, _, err := m.latest(ctx)
+	if err != nil {
+		return l, err
+	}
+	b, err := m.goMod(ctx, latest)
+	if err != nil {
+		return l, fmt.Errorf("read go.mod at %s: %w", latest.Version, err)
+	}
+	f, err := modfile.ParseLax("go.mod", b, nil)
+	if err != nil {
+		return l, fmt.Errorf("parse go.mod at %s: %w", latest.Version, err)
+	}
+	if f.Module != nil && f.Module.Deprecated != "" {
+		l.Deprecated, l.Deprecation = true, f.Module.Deprecated
+	}
+
+	for i := len(vs) - 1; i >= 0; i-- {
+		r := Release{
+			Version: vs[i].Version,
+			Time:    vs[i].Time,
+		}
+		for _, rt := range f.Retract {
+			if semver.Compare(rt.Low, r.Version) <= 0 && semver.Compare(r.Version, rt.High) <= 0 {
+				r.Retracted, r.Rationale = true, rt.Rationale
+				break
+			}
+		}
+		l.Versions = append(l.Versions, r)
+	}
+	for i, r := range l.Versions {
+		if r.Retracted {
+			continue
+		}
+		if semver.Prerelease(r.Version) == "" {
+			l.Latest = &l.Versions[i]
+			break
+		} else if l.LatestPrerelease == nil {
+			l.LatestPrerelease = &l.Versions[i]
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,297 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// version is a module version and the commit it comes from
+type version struct {
+	Version string
+	Hash    string
+	Time    time.Time
+}
+
+func (m Module) tagPrefix() string {
+	if m.Subdir == "" {
+		return ""
+	}
+	return m.Subdir + "/"
+}
+
+// canIncompatible reports whether v2+ versions without a major version suffix
+// can be used as +incompatible, only possible at the repository root
+func (m Module) canIncompatible() bool {
+	_, pathMajor, _ := module.SplitPathVersion(m.Path)
+	return pathMajor == "" && m.Subdir == ""
+}
+
+// hasGoMod reports whether the module has a go.mod file at a commit
+func (m Module) hasGoMod(ctx context.Context, hash string) (bool, error) {
+	_, err := m.Repo.ReadFile(ctx, hash, path.Join(m.Subdir, "go.mod"))
+	if errors.Is(err, gitrepo.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// versions lists the tagged versions of the module, sorted from lowest to highest.
+// Like the go command, v2+ tags of modules without a major version suffix
+// are +incompatible versions, as long as no go.mod file says otherwise.
+func (m Module) versions(ctx context.Context) ([]version, error) {
+	tags, err := m.Repo.Tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, pathMajor, _ := module.SplitPathVersion(m.Path)
+	var list, incompatible []version
+	for _, t := range gitrepo.Versions(tags, m.tagPrefix()) {
+		v := version{t.Name, t.Hash, t.Time}
+		if module.CheckPathMajor(t.Name, pathMajor) == nil {
+			list = append(list, v)
+		} else if m.canIncompatible() && semver.Build(t.Name) == "" {
+			incompatible = append(incompatible, v)
+		}
+	}
+	if len(incompatible) == 0 {
+		return list, nil
+	}
+
+	// assume that once the latest compatible version has a go.mod,
+	// all later major versions do as well
+	if len(list) > 0 {
+		ok, err := m.hasGoMod(ctx, list[len(list)-1].Hash)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return list, nil
+		}
+	}
+	// majors where the latest version has a go.mod are excluded
+	var lastMajor string
+	var lastMajorHasGoMod bool
+	for i, v := range incompatible {
+		major := semver.Major(v.Version)
+		if major != lastMajor {
+			rem := incompatible[i:]
+			j := sort.Search(len(rem), func(j int) bool {
+				return semver.Major(rem[j].Version) != major
+			})
+			lastMajorHasGoMod, err = m.hasGoMod(ctx, rem[j-1].Hash)
+			if err != nil {
+				return nil, err
+			}
+			lastMajor = major
+		}
+		if lastMajorHasGoMod {
+			continue
+		}
+		v.Version += "+incompatible"
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// latest is the highest release, or the highest prerelease,
+// or a pseudo-version for HEAD if there are no tagged versions.
+func (m Module) latest(ctx context.Context) (version, bool, error) {
+	vs, err := m.versions(ctx)
+	if err != nil {
+		return version{}, false, err
+	}
+	for i := len(vs) - 1; i >= 0; i-- {
+		if semver.Prerelease(vs[i].Version) == "" {
+			return vs[i], true, nil
+		}
+	}
+	if len(vs) > 0 {
+		return vs[len(vs)-1], true, nil
+	}
+	return m.query(ctx, "HEAD")
+}
+
+// lookup finds a canonical version: a tagged version or a pseudo-version
+func (m Module) lookup(ctx context.Context, v string) (version, bool, error) {
+	if module.IsPseudoVersion(v) {
+		return m.lookupPseudo(ctx, v)
+	}
+
+	vs, err := m.versions(ctx)
+	if err != nil {
+		return version{}, false, err
+	}
+	for _, tv := range vs {
+		if tv.Version == v {
+			return tv, true, nil
+		}
+	}
+	return version{}, false, nil
+}
+
+// lookupPseudo checks a pseudo-version the way the go command does.
+// It doesn't have to be the one query gives today:
+// pseudo-versions handed out before new tags were added stay valid,
+// as long as the hash and time match the commit,
+// and the base, if any, is a tag on an ancestor of the commit
+// but not on the commit itself.
+func (m Module) lookupPseudo(ctx context.Context, v string) (version, bool, error) {
+	rev, err := module.PseudoVersionRev(v)
+	if err != nil || len(rev) != 12 {
+		return version{}, false, nil
+	}
+	t, err := module.PseudoVersionTime(v)
+	if err != nil {
+		return version{}, false, nil
+	}
+	base, err := module.PseudoVersionBase(v)
+	if err != nil {
+		return version{}, false, nil
+	}
+	base = strings.TrimSuffix(base, "+incompatible")
+	c, err := m.Repo.Resolve(ctx, rev)
+	if errors.Is(err, gitrepo.ErrUnknownRevision) {
+		return version{}, false, nil
+	} else if err != nil {
+		return version{}, false, err
+	}
+	if shortHash(c.Hash) != rev || !c.Time.Equal(t) {
+		return version{}, false, nil
+	}
+
+	_, pathMajor, _ := module.SplitPathVersion(m.Path)
+	switch semver.Build(v) {
+	case "":
+		if module.CheckPathMajor(v, pathMajor) != nil {
+			return version{}, false, nil
+		}
+	case "+incompatible":
+		if !m.canIncompatible() || module.CheckPathMajor(strings.TrimSuffix(v, "+incompatible"), pathMajor) == nil {
+			return version{}, false, nil
+		}
+		hasGoMod, err := m.hasGoMod(ctx, c.Hash)
+		if err != nil || hasGoMod {
+			return version{}, false, err
+		}
+	default:
+		return version{}, false, nil
+	}
+
+	pv := version{v, c.Hash, c.Time}
+	if base == "" {
+		// v0.0.0 or the major version of the path
+		if pathMajor == "" && semver.Major(v) == "v1" {
+			return version{}, false, nil
+		}
+		return pv, true, nil
+	}
+	tags, err := m.Repo.TagsMerged(ctx, c.Hash)
+	if err != nil {
+		return version{}, false, err
+	}
+	for _, tag := range gitrepo.Versions(tags, m.tagPrefix()) {
+		if tag.Name == base {
+			// a tagged commit should use its tag
+			return pv, tag.Hash != c.Hash, nil
+		}
+	}
+	return version{}, false, nil
+}
+
+// stat resolves a version or a revision query (branch, tag or commit hash)
+func (m Module) stat(ctx context.Context, q string) (version, bool, error) {
+	if semver.IsValid(q) {
+		v, ok, err := m.lookup(ctx, q)
+		if err != nil || ok || semver.Build(q) != "" || !m.canIncompatible() {
+			return v, ok, err
+		}
+		// v2.0.0 can mean v2.0.0+incompatible
+		return m.lookup(ctx, q+"+incompatible")
+	}
+	return m.query(ctx, q)
+}
+
+// query resolves a revision to the version the go command would use for it:
+// a version tag on the commit if there is one, or a pseudo-version
+// based on the highest version tag reachable from the commit.
+func (m Module) query(ctx context.Context, rev string) (version, bool, error) {
+	c, err := m.Repo.Resolve(ctx, rev)
+	if errors.Is(err, gitrepo.ErrUnknownRevision) {
+		return version{}, false, nil
+	} else if err != nil {
+		return version{}, false, err
+	}
+
+	tags, err := m.Repo.TagsMerged(ctx, c.Hash)
+	if err != nil {
+		return version{}, false, err
+	}
+	_, pathMajor, _ := module.SplitPathVersion(m.Path)
+	var incompatibleOK, checkedGoMod bool
+	allowed := func(v string) (bool, error) {
+		if module.CheckPathMajor(v, pathMajor) == nil {
+			return true, nil
+		}
+		if !m.canIncompatible() || semver.Build(v) != "" {
+			return false, nil
+		}
+		if !checkedGoMod {
+			hasGoMod, err := m.hasGoMod(ctx, c.Hash)
+			if err != nil {
+				return false, err
+			}
+			incompatibleOK, checkedGoMod = !hasGoMod, true
+		}
+		return incompatibleOK, nil
+	}
+
+	var base string
+	vs := gitrepo.Versions(tags, m.tagPrefix())
+	for i := len(vs) - 1; i >= 0; i-- {
+		ok, err := allowed(vs[i].Name)
+		if err != nil {
+			return version{}, false, err
+		} else if !ok {
+			continue
+		}
+		v := vs[i].Name
+		if module.CheckPathMajor(v, pathMajor) != nil {
+			v += "+incompatible"
+		}
+		if vs[i].Hash == c.Hash {
+			// tagged commit
+			return version{v, c.Hash, c.Time}, true, nil
+		}
+		if base == "" {
+			base = vs[i].Name
+		}
+	}
+
+	major := strings.TrimPrefix(pathMajor, "/")
+	if strings.HasPrefix(pathMajor, ".") {
+		// gopkg.in/foo.v2
+		major = strings.TrimPrefix(pathMajor, ".")
+	}
+	pseudo := module.PseudoVersion(major, base, c.Time, shortHash(c.Hash))
+	if module.CheckPathMajor(pseudo, pathMajor) != nil {
+		pseudo += "+incompatible"
+	}
+	return version{pseudo, c.Hash, c.Time}, true, nil
+}
+
+// shortHash is the 12 character prefix used in pseudo-versions
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
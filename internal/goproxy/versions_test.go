@@ -0,0 +1,327 @@
+package goproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+)
+
+// fixture is a git repository with commits an hour apart from epoch
+type fixture struct {
+	t   *testing.T
+	dir string
+	n   int
+}
+
+var epoch = time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("no git: %v", err)
+	}
+	f := &fixture{t: t, dir: t.TempDir()}
+	f.git("init", "--quiet", "-b", "master")
+	return f
+}
+
+func (f *fixture) git(args ...string) string {
+	f.t.Helper()
+	date := epoch.Add(time.Duration(f.n) * time.Hour).Format(time.RFC3339)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = f.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@vanity.test", "GIT_AUTHOR_DATE="+date,
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@vanity.test", "GIT_COMMITTER_DATE="+date,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		f.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files, removing the ones with empty contents,
+// and returns the new commit hash
+func (f *fixture) commit(files map[string]string) string {
+	f.t.Helper()
+	for name, content := range files {
+		fn := filepath.Join(f.dir, filepath.FromSlash(name))
+		if content == "" {
+			f.git("rm", "--quiet", name)
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	f.n++
+	f.git("add", ".")
+	f.git("commit", "--quiet", "--allow-empty", "-m", "commit")
+	return f.git("rev-parse", "HEAD")
+}
+
+func (f *fixture) tag(name, hash string) {
+	f.t.Helper()
+	f.git("tag", name, hash)
+}
+
+// time is the pseudo-version timestamp of the nth commit
+func (f *fixture) time(n int) string {
+	return epoch.Add(time.Duration(n) * time.Hour).Format("20060102150405")
+}
+
+func (f *fixture) module(p, subdir string) Module {
+	f.t.Helper()
+	repo, err := gitrepo.Open(context.Background(), f.dir)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return Module{Path: p, Subdir: subdir, Repo: repo}
+}
+
+func checkQuery(t *testing.T, m Module, rev, want string) {
+	t.Helper()
+	v, ok, err := m.stat(context.Background(), rev)
+	if err != nil {
+		t.Fatalf("stat %s: %v", rev, err)
+	} else if !ok {
+		t.Fatalf("stat %s: not found", rev)
+	}
+	if v.Version != want {
+		t.Errorf("stat %s = %s, want %s", rev, v.Version, want)
+	}
+}
+
+func checkVersions(t *testing.T, m Module, want ...string) {
+	t.Helper()
+	vs, err := m.versions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range vs {
+		got = append(got, v.Version)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("versions = %q, want %q", got, want)
+	}
+}
+
+func TestPseudoVersion(t *testing.T) {
+	t.Run("untagged", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+		m := f.module("vanity.test/m", "")
+		checkQuery(t, m, "HEAD", "v0.0.0-"+f.time(1)+"-"+c1[:12])
+		checkQuery(t, m, "master", "v0.0.0-"+f.time(1)+"-"+c1[:12])
+	})
+
+	t.Run("release base", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+		f.tag("v1.2.3", c1)
+		c2 := f.commit(map[string]string{"a.go": "package m\n"})
+		m := f.module("vanity.test/m", "")
+		// the tagged commit is its version, descendants are pseudo-versions
+		checkQuery(t, m, c1, "v1.2.3")
+		checkQuery(t, m, c1[:7], "v1.2.3")
+		checkQuery(t, m, c2, "v1.2.4-0."+f.time(2)+"-"+c2[:12])
+	})
+
+	t.Run("prerelease base", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+		f.tag("v1.0.0", c1)
+		c2 := f.commit(map[string]string{"a.go": "package m\n"})
+		f.tag("v1.1.0-pre", c2)
+		c3 := f.commit(map[string]string{"b.go": "package m\n"})
+		m := f.module("vanity.test/m", "")
+		checkQuery(t, m, c2, "v1.1.0-pre")
+		checkQuery(t, m, c3, "v1.1.0-pre.0."+f.time(3)+"-"+c3[:12])
+	})
+
+	t.Run("unmerged tags", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+		f.tag("v1.0.0", c1)
+		c2 := f.commit(map[string]string{"a.go": "package m\n"})
+		f.git("checkout", "--quiet", "-b", "side", c1)
+		c3 := f.commit(map[string]string{"b.go": "package m\n"})
+		f.tag("v1.5.0", c2)
+		m := f.module("vanity.test/m", "")
+		// v1.5.0 isn't an ancestor of c3
+		checkQuery(t, m, c3, "v1.0.1-0."+f.time(3)+"-"+c3[:12])
+	})
+
+	t.Run("subdir", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"sub/go.mod": "module vanity.test/m/sub\n"})
+		f.tag("v9.0.0", c1)
+		f.tag("sub/v0.3.0", c1)
+		c2 := f.commit(map[string]string{"sub/a.go": "package sub\n"})
+		m := f.module("vanity.test/m/sub", "sub")
+		checkVersions(t, m, "v0.3.0")
+		checkQuery(t, m, c2, "v0.3.1-0."+f.time(2)+"-"+c2[:12])
+	})
+
+	t.Run("major version suffix with v1 tags", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+		f.tag("v1.0.0", c1)
+		c2 := f.commit(map[string]string{"go.mod": "module vanity.test/m/v2\n"})
+		m := f.module("vanity.test/m/v2", "")
+		checkVersions(t, m)
+		checkQuery(t, m, c2, "v2.0.0-"+f.time(2)+"-"+c2[:12])
+
+		f.tag("v2.0.0", c2)
+		c3 := f.commit(map[string]string{"a.go": "package m\n"})
+		checkVersions(t, m, "v2.0.0")
+		checkQuery(t, m, c3, "v2.0.1-0."+f.time(3)+"-"+c3[:12])
+	})
+
+	t.Run("gopkg.in", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"a.go": "package m\n"})
+		f.tag("v1.0.0", c1)
+		c2 := f.commit(map[string]string{"b.go": "package m\n"})
+		m := f.module("gopkg.in/m.v2", "")
+		checkVersions(t, m)
+		checkQuery(t, m, c2, "v2.0.0-"+f.time(2)+"-"+c2[:12])
+
+		f.tag("v2.1.0", c2)
+		c3 := f.commit(map[string]string{"c.go": "package m\n"})
+		checkVersions(t, m, "v2.1.0")
+		checkQuery(t, m, c2, "v2.1.0")
+		checkQuery(t, m, c3, "v2.1.1-0."+f.time(3)+"-"+c3[:12])
+	})
+}
+
+func TestIncompatible(t *testing.T) {
+	t.Run("without go.mod", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"a.go": "package m\n"})
+		f.tag("v1.0.0", c1)
+		c2 := f.commit(map[string]string{"b.go": "package m\n"})
+		f.tag("v2.0.0", c2)
+		c3 := f.commit(map[string]string{"c.go": "package m\n"})
+		m := f.module("vanity.test/m", "")
+		checkVersions(t, m, "v1.0.0", "v2.0.0+incompatible")
+		checkQuery(t, m, "v2.0.0", "v2.0.0+incompatible")
+		checkQuery(t, m, "v2.0.0+incompatible", "v2.0.0+incompatible")
+		checkQuery(t, m, c3, "v2.0.1-0."+f.time(3)+"-"+c3[:12]+"+incompatible")
+		checkQuery(t, m, "v2.0.1-0."+f.time(3)+"-"+c3[:12]+"+incompatible", "v2.0.1-0."+f.time(3)+"-"+c3[:12]+"+incompatible")
+
+		// not for modules in subdirectories
+		sub := f.module("vanity.test/m/sub", "sub")
+		checkVersions(t, sub)
+	})
+
+	t.Run("with go.mod", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"a.go": "package m\n"})
+		f.tag("v1.0.0", c1)
+		c2 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+		f.tag("v2.0.0", c2)
+		c3 := f.commit(map[string]string{"b.go": "package m\n"})
+		m := f.module("vanity.test/m", "")
+		// the go.mod says it's still vanity.test/m, so v2 tags don't count
+		checkVersions(t, m, "v1.0.0")
+		checkQuery(t, m, c3, "v1.0.1-0."+f.time(3)+"-"+c3[:12])
+		_, ok, err := m.stat(context.Background(), "v2.0.0")
+		if err != nil || ok {
+			t.Errorf("stat v2.0.0 = %v, %v, want not found", ok, err)
+		}
+	})
+
+	t.Run("go.mod added in later major", func(t *testing.T) {
+		f := newFixture(t)
+		c1 := f.commit(map[string]string{"a.go": "package m\n"})
+		f.tag("v2.0.0", c1)
+		c2 := f.commit(map[string]string{"go.mod": "module vanity.test/m/v3\n"})
+		f.tag("v3.0.0", c2)
+		m := f.module("vanity.test/m", "")
+		checkVersions(t, m, "v2.0.0+incompatible")
+	})
+}
+
+func TestLookupPseudo(t *testing.T) {
+	f := newFixture(t)
+	c1 := f.commit(map[string]string{"go.mod": "module vanity.test/m\n"})
+	f.tag("v1.0.0", c1)
+	c2 := f.commit(map[string]string{"a.go": "package m\n"})
+	c3 := f.commit(map[string]string{"b.go": "package m\n"})
+	f.git("checkout", "--quiet", "-b", "side", c1)
+	c4 := f.commit(map[string]string{"c.go": "package m\n"})
+	f.tag("v1.5.0", c4)
+	m := f.module("vanity.test/m", "")
+	ctx := context.Background()
+
+	checkLookup := func(pv, hash string) {
+		t.Helper()
+		v, ok, err := m.lookup(ctx, pv)
+		if err != nil || !ok || v.Hash != hash || v.Version != pv {
+			t.Errorf("lookup %s = %v, %v, %v, want %s", pv, v, ok, err, hash)
+		}
+	}
+
+	// handed out before the tags below were added
+	handed := "v1.0.1-0." + f.time(3) + "-" + c3[:12]
+	checkQuery(t, m, c3, handed)
+	checkLookup(handed, c3)
+
+	// a new tag on an ancestor changes what's handed out,
+	// but existing pseudo-versions keep working
+	f.tag("v1.1.0", c2)
+	checkQuery(t, m, c3, "v1.1.1-0."+f.time(3)+"-"+c3[:12])
+	checkLookup(handed, c3)
+	checkQuery(t, m, handed, handed)
+
+	// and so does a tag on the commit itself
+	f.tag("v1.2.0", c3)
+	checkQuery(t, m, c3, "v1.2.0")
+	checkLookup(handed, c3)
+
+	// no base
+	checkLookup("v0.0.0-"+f.time(3)+"-"+c3[:12], c3)
+	checkLookup("v0.0.0-"+f.time(1)+"-"+c1[:12], c1)
+
+	for _, pv := range []string{
+		// base tagged on the commit itself
+		"v1.0.1-0." + f.time(1) + "-" + c1[:12],
+		"v1.1.1-0." + f.time(2) + "-" + c2[:12],
+		// base not an ancestor
+		"v1.5.1-0." + f.time(3) + "-" + c3[:12],
+		// base not a tag
+		"v1.3.1-0." + f.time(3) + "-" + c3[:12],
+		// no base needs v0
+		"v1.0.0-" + f.time(3) + "-" + c3[:12],
+		// wrong major
+		"v2.0.0-" + f.time(3) + "-" + c3[:12],
+		"v1.0.1-0." + f.time(3) + "-" + c3[:12] + "+incompatible",
+		// wrong time
+		"v1.0.1-0." + f.time(2) + "-" + c3[:12],
+		// not the 12 character hash
+		"v1.0.1-0." + f.time(3) + "-" + c3[:10],
+		// unknown commit
+		"v1.0.1-0." + f.time(3) + "-000000000000",
+	} {
+		_, ok, err := m.lookup(ctx, pv)
+		if err != nil || ok {
+			t.Errorf("lookup %s = %v, %v, want not found", pv, ok, err)
+		}
+	}
+}
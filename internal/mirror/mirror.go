@@ -0,0 +1,242 @@
+// Package mirror keeps local bare clones of the git repositories modules live in,
+// serves them over git smart HTTP,
+// and tracks whether the originals are reachable,
+// so go-import tags can fail over to the mirror during a forge outage.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"k8s.io/klog/v2"
+)
+
+// syncTimeout bounds a single clone or fetch,
+// so an unresponsive origin is marked as down
+const syncTimeout = 5 * time.Minute
+
+// Mirror is a set of mirrored repositories stored in dir/<host>/<path>.git
+type Mirror struct {
+	dir      string
+	interval time.Duration
+
+	mu    sync.Mutex
+	repos map[string]*repo  // by name
+	names map[string]string // by url
+}
+
+type repo struct {
+	name string
+	url  string
+
+	// ready is set once the clone exists
+	ready bool
+	// healthy is the result of the last sync with the origin
+	healthy bool
+}
+
+// New creates a mirror in dir, syncing every interval once Run
+func New(dir string, interval time.Duration) *Mirror {
+	return &Mirror{
+		dir:      dir,
+		interval: interval,
+		repos:    make(map[string]*repo),
+		names:    make(map[string]string),
+	}
+}
+
+// Add registers a repository url to be mirrored,
+// returning the name the mirror is served under
+func (mr *Mirror) Add(u string) (string, error) {
+	name, err := Name(u)
+	if err != nil {
+		return "", err
+	}
+	return name, mr.add(u, name)
+}
+
+// add registers a repository url to be mirrored under name
+func (mr *Mirror) add(u, name string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if r, ok := mr.repos[name]; ok {
+		if r.url != u {
+			return fmt.Errorf("%s and %s both mirror to %s", r.url, u, name)
+		}
+		return nil
+	}
+	_, err := os.Stat(filepath.Join(mr.dir, filepath.FromSlash(name)))
+	mr.repos[name] = &repo{
+		name: name,
+		url:  u,
+		// a clone left from a previous run can be served right away,
+		// we don't know about the origin until the first sync
+		ready:   err == nil,
+		healthy: true,
+	}
+	mr.names[u] = name
+	return nil
+}
+
+// Name is the path a repository url is mirrored under:
+// its host and path, ending in .git.
+// Local repositories, as file:// urls or paths, aren't mirrored,
+// their names would publish where they are on the server.
+func Name(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if pu.Scheme == "file" || pu.Host == "" || pu.Path == "" {
+		return "", fmt.Errorf("%s: not a remote repository url", u)
+	}
+	name := path.Clean(strings.ToLower(pu.Hostname()) + "/" + pu.Path)
+	if !strings.Contains(name, "/") {
+		return "", fmt.Errorf("%s: no repository path", u)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || strings.HasPrefix(elem, ".") {
+			return "", fmt.Errorf("%s: invalid path element %q", u, elem)
+		}
+	}
+	if !strings.HasSuffix(name, ".git") {
+		name += ".git"
+	}
+	return name, nil
+}
+
+// Failover is the name of the mirror to point to instead of a repository url,
+// ok is false if the origin is fine or there isn't a mirror ready.
+func (mr *Mirror) Failover(u string) (name string, ok bool) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	name, ok = mr.names[u]
+	if !ok {
+		return "", false
+	}
+	r := mr.repos[name]
+	if r.healthy || !r.ready {
+		return "", false
+	}
+	return name, true
+}
+
+// Run syncs all repositories with their origins every interval,
+// until ctx is done
+func (mr *Mirror) Run(ctx context.Context) {
+	t := time.NewTicker(mr.interval)
+	defer t.Stop()
+	for {
+		mr.mu.Lock()
+		repos := make([]repo, 0, len(mr.repos))
+		for _, r := range mr.repos {
+			repos = append(repos, *r)
+		}
+		mr.mu.Unlock()
+
+		// one unresponsive origin shouldn't hold up the others
+		var wg sync.WaitGroup
+		for _, r := range repos {
+			wg.Add(1)
+			go func(r repo) {
+				defer wg.Done()
+				mr.update(ctx, r)
+			}(r)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// update syncs a repository and records the health of its origin
+func (mr *Mirror) update(ctx context.Context, r repo) {
+	err := mr.sync(ctx, r)
+	if ctx.Err() != nil {
+		return
+	}
+	mr.mu.Lock()
+	mr.repos[r.name].healthy = err == nil
+	if err == nil {
+		mr.repos[r.name].ready = true
+	}
+	mr.mu.Unlock()
+	if err != nil {
+		klog.ErrorS(err, "sync mirror, origin marked down", "repo", r.url)
+	} else if !r.healthy {
+		klog.InfoS("origin back up", "repo", r.url)
+	}
+}
+
+// sync clones or fetches a repository from its origin
+func (mr *Mirror) sync(ctx context.Context, r repo) error {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	dir := filepath.Join(mr.dir, filepath.FromSlash(r.name))
+	g, err := gitrepo.Open(ctx, dir)
+	if err != nil {
+		if _, serr := os.Stat(dir); serr == nil {
+			return fmt.Errorf("open %s: %w", dir, err)
+		}
+		_, err = gitrepo.Mirror(ctx, r.url, dir)
+		return err
+	}
+	return g.Fetch(ctx)
+}
+
+// Handler serves the mirrors over git smart HTTP, read only, under prefix
+func (mr *Mirror) Handler(prefix string) (http.Handler, error) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(mr.dir)
+	if err != nil {
+		return nil, err
+	}
+	backend := &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Root: prefix,
+		Dir:  dir,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + dir,
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// pushes are off without REMOTE_USER, but don't even try
+		if r.URL.Query().Get("service") == "git-receive-pack" || strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+			http.Error(w, "read only", http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, prefix+"/")
+		if i := strings.Index(name, ".git/"); i >= 0 {
+			name = name[:i+len(".git")]
+		}
+		mr.mu.Lock()
+		rp, ok := mr.repos[name]
+		ok = ok && rp.ready
+		mr.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,256 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://github.com/seankhliao/vanity", "github.com/seankhliao/vanity.git"},
+		{"https://GitHub.com/seankhliao/vanity.git", "github.com/seankhliao/vanity.git"},
+		{"https://git.example.com:8443/a/b/c/", "git.example.com/a/b/c.git"},
+		{"ssh://git@example.com/repo", "example.com/repo.git"},
+		{"https://example.com//a/./b/", "example.com/a/b.git"},
+		{"https://example.com/a/../b", "example.com/b.git"},
+	}
+	for _, tt := range tests {
+		got, err := Name(tt.url)
+		if err != nil || got != tt.want {
+			t.Errorf("Name(%q) = %q, %v, want %q", tt.url, got, err, tt.want)
+		}
+	}
+
+	for _, u := range []string{
+		"",
+		"relative/path",
+		"https://example.com",
+		"https://example.com/",
+		"https:///repo",
+		"file://",
+		"file:///",
+		// local repositories would publish the server's paths
+		"file:///srv/git/repo.git",
+		"file://host/srv/git/repo",
+		"/srv/git/repo",
+		"/",
+		"https://example.com/../../etc",
+		"https://example.com/.hidden/repo",
+	} {
+		got, err := Name(u)
+		if err == nil {
+			t.Errorf("Name(%q) = %q, want error", u, got)
+		}
+	}
+}
+
+// origin is a repository to mirror
+type origin struct {
+	t   *testing.T
+	dir string
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@vanity.test",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@vanity.test",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func newOrigin(t *testing.T) *origin {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("no git: %v", err)
+	}
+	o := &origin{t: t, dir: filepath.Join(t.TempDir(), "origin.git")}
+	err := os.Mkdir(o.dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, o.dir, "init", "--quiet", "-b", "main")
+	return o
+}
+
+func (o *origin) commit(msg string) string {
+	o.t.Helper()
+	git(o.t, o.dir, "commit", "--quiet", "--allow-empty", "-m", msg)
+	return git(o.t, o.dir, "rev-parse", "HEAD")
+}
+
+// syncAll syncs every repository once, like a round of Run
+func syncAll(mr *Mirror) {
+	mr.mu.Lock()
+	var repos []repo
+	for _, r := range mr.repos {
+		repos = append(repos, *r)
+	}
+	mr.mu.Unlock()
+	for _, r := range repos {
+		mr.update(context.Background(), r)
+	}
+}
+
+// remoteHead is the main branch of a mirror, fetched over http
+func remoteHead(t *testing.T, url string) string {
+	t.Helper()
+	out := git(t, t.TempDir(), "ls-remote", url, "refs/heads/main")
+	return strings.Fields(out + " ")[0]
+}
+
+func TestMirror(t *testing.T) {
+	o := newOrigin(t)
+	c1 := o.commit("one")
+	// local origins can't be named, see TestName
+	const name = "example.com/origin.git"
+	mr := New(t.TempDir(), time.Hour)
+	err := mr.add(o.dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := mr.Handler("/.mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	url := srv.URL + "/.mirror/" + name
+
+	// not served until cloned
+	res, err := http.Get(url + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("before clone: %s, want 404", res.Status)
+	}
+
+	// clone
+	syncAll(mr)
+	if got := remoteHead(t, url); got != c1 {
+		t.Errorf("after clone: main = %s, want %s", got, c1)
+	}
+	if _, ok := mr.Failover(o.dir); ok {
+		t.Error("failover with a healthy origin")
+	}
+
+	// fetch
+	c2 := o.commit("two")
+	syncAll(mr)
+	if got := remoteHead(t, url); got != c2 {
+		t.Errorf("after fetch: main = %s, want %s", got, c2)
+	}
+
+	// origin gone
+	moved := o.dir + ".moved"
+	err = os.Rename(o.dir, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncAll(mr)
+	if got, ok := mr.Failover(o.dir); !ok || got != name {
+		t.Errorf("Failover with origin down = %q, %v, want %q", got, ok, name)
+	}
+	if _, ok := mr.Failover("https://example.com/origin"); ok {
+		t.Error("failover for a url that isn't mirrored")
+	}
+	if got := remoteHead(t, url); got != c2 {
+		t.Errorf("with origin down: main = %s, want %s", got, c2)
+	}
+
+	// recovery
+	err = os.Rename(moved, o.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncAll(mr)
+	if _, ok := mr.Failover(o.dir); ok {
+		t.Error("failover after origin recovered")
+	}
+
+	// reopened with the existing clone
+	mr2 := New(mr.dir, time.Hour)
+	err = mr2.add(o.dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := mr2.repos[name]; !r.ready {
+		t.Error("existing clone not ready")
+	}
+
+	// names are only shared by the same url
+	err = mr2.add(o.dir+".other", name)
+	if err == nil {
+		t.Error("two urls mirrored under the same name")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	o := newOrigin(t)
+	o.commit("one")
+	const name = "example.com/origin.git"
+	mr := New(t.TempDir(), time.Hour)
+	err := mr.add(o.dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncAll(mr)
+	h, err := mr.Handler("/.mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, req := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/.mirror/" + name + "/info/refs?service=git-upload-pack", http.StatusOK},
+		{http.MethodGet, "/.mirror/" + name + "/info/refs?service=git-receive-pack", http.StatusForbidden},
+		{http.MethodPost, "/.mirror/" + name + "/git-receive-pack", http.StatusForbidden},
+		{http.MethodGet, "/.mirror/example.com/unknown.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+	} {
+		r, err := http.NewRequest(req.method, srv.URL+req.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != req.want {
+			t.Errorf("%s %s = %s, want %d", req.method, req.path, res.Status, req.want)
+		}
+	}
+
+	// a push through git is refused too
+	work := t.TempDir()
+	git(t, work, "clone", "--quiet", srv.URL+"/.mirror/"+name, ".")
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "pushed")
+	cmd := exec.Command("git", "push", "origin", "HEAD:main")
+	cmd.Dir = work
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("push to mirror succeeded:\n%s", out)
+	}
+}
@@ -0,0 +1,137 @@
+// Package modzip creates module zip files from git repositories,
+// the same way the go command does when fetching directly from version control,
+// so that their h1: hashes match the ones in go.sum.
+package modzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Create writes the zip for module version m at git revision rev to w.
+// subdir is the directory in the repository holding the module.
+//
+// Like the go command, it starts from git archive (respecting export-ignore),
+// keeps only the files in subdir, adds the repository root LICENSE
+// to modules in subdirectories without their own,
+// and leaves the rest to golang.org/x/mod/zip:
+// excluding vendor directories and nested modules,
+// and enforcing the file name and size limits.
+func Create(ctx context.Context, w io.Writer, repo *gitrepo.Repo, m module.Version, rev, subdir string) error {
+	b, err := repo.Archive(ctx, rev, subdir)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > modzip.MaxZipFile {
+		return fmt.Errorf("archive of %s too large: %d bytes", m, len(b))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return fmt.Errorf("read archive of %s: %w", m, err)
+	}
+
+	prefix := ""
+	if subdir != "" {
+		prefix = subdir + "/"
+	}
+	var files []modzip.File
+	var haveLICENSE bool
+	for _, zf := range zr.File {
+		name := zf.Name
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		name = strings.TrimPrefix(name, prefix)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		files = append(files, zipFile{name: name, f: zf})
+		if name == "LICENSE" {
+			haveLICENSE = true
+		}
+	}
+
+	if !haveLICENSE && subdir != "" {
+		data, err := repo.ReadFile(ctx, rev, "LICENSE")
+		if err == nil && int64(len(data)) <= modzip.MaxLICENSE {
+			files = append(files, dataFile{name: "LICENSE", data: data})
+		} else if err != nil && !errors.Is(err, gitrepo.ErrNotExist) {
+			return fmt.Errorf("read LICENSE of %s: %w", m, err)
+		}
+	}
+
+	return modzip.Create(w, m, files)
+}
+
+// Hash computes the h1: hash of a module zip, as recorded in go.sum
+func Hash(b []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	zfs := make(map[string]*zip.File, len(zr.File))
+	for _, zf := range zr.File {
+		if _, ok := zfs[zf.Name]; ok {
+			return "", fmt.Errorf("duplicate file %s", zf.Name)
+		}
+		names = append(names, zf.Name)
+		zfs[zf.Name] = zf
+	}
+	return dirhash.Hash1(names, func(name string) (io.ReadCloser, error) {
+		return zfs[name].Open()
+	})
+}
+
+// HashMod computes the h1: hash of a go.mod file, as recorded in go.sum
+func HashMod(b []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
+// zipFile is a file in a git archive
+type zipFile struct {
+	name string
+	f    *zip.File
+}
+
+func (f zipFile) Path() string                 { return f.name }
+func (f zipFile) Lstat() (os.FileInfo, error)  { return f.f.FileInfo(), nil }
+func (f zipFile) Open() (io.ReadCloser, error) { return f.f.Open() }
+
+// dataFile is a file read from the repository
+type dataFile struct {
+	name string
+	data []byte
+}
+
+func (f dataFile) Path() string                { return f.name }
+func (f dataFile) Lstat() (os.FileInfo, error) { return dataFileInfo{f}, nil }
+func (f dataFile) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+type dataFileInfo struct {
+	f dataFile
+}
+
+func (fi dataFileInfo) Name() string       { return fi.f.name }
+func (fi dataFileInfo) Size() int64        { return int64(len(fi.f.data)) }
+func (fi dataFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi dataFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi dataFileInfo) IsDir() bool        { return false }
+func (fi dataFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,212 @@
+package modzip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"golang.org/x/mod/module"
+)
+
+// the go command finds the repository through the .git in the module path,
+// fetching https://vanity.test/repo, which git rewrites to the fixture
+const repoPath = "vanity.test/repo.git"
+
+// TestHashGoModDownload compares hashes with the ones
+// the go command records for the same fixture
+func TestHashGoModDownload(t *testing.T) {
+	for _, bin := range []string{"git", "go"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("no %s: %v", bin, err)
+		}
+	}
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "repo")
+	env := goEnv(t, dir, repoDir)
+
+	writeFiles(t, repoDir, map[string]string{
+		"go.mod":     "module " + repoPath + "\n\ngo 1.14\n",
+		"LICENSE":    "root license\n",
+		"a.go":       "package repo\n",
+		"crlf.txt":   "windows\r\nline endings\r\n",
+		"docs/b.txt": "nested dir\n",
+		// vendor directories are left out
+		"vendor/modules.txt":           "# example.com/dep v1.0.0\n",
+		"vendor/example.com/dep/d.go":  "package dep\n",
+		"internal/vendor/keep/keep.go": "package keep\n",
+		// nested modules are left out
+		"nested/go.mod":  "module " + repoPath + "/nested\n",
+		"nested/n.go":    "package nested\n",
+		"nested/x/x.txt": "in nested module\n",
+		// sub has no LICENSE, it gets the one from the root
+		"sub/go.mod":  "module " + repoPath + "/sub\n\ngo 1.14\n",
+		"sub/s.go":    "package sub\n",
+		"sub/crlf.go": "package sub\r\n",
+		// own has its own LICENSE
+		"own/go.mod":  "module " + repoPath + "/own\n\ngo 1.14\n",
+		"own/LICENSE": "own license\n",
+		"own/o.go":    "package own\n",
+	})
+	for link, target := range map[string]string{
+		"link.go":     "a.go",
+		"sub/link.go": "s.go",
+		"linkdir":     "docs",
+	} {
+		err := os.Symlink(target, filepath.Join(repoDir, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, repoDir, "init", "--quiet")
+	git(t, repoDir, "add", ".")
+	git(t, repoDir, "commit", "--quiet", "-m", "init")
+	for _, tag := range []string{"v1.0.0", "sub/v1.0.0", "own/v1.0.0", "nested/v1.0.0"} {
+		git(t, repoDir, "tag", tag)
+	}
+
+	ctx := context.Background()
+	repo, err := gitrepo.Open(ctx, repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, subdir string
+	}{
+		{"root", ""},
+		{"subdir", "sub"},
+		{"subdir with LICENSE", "own"},
+		{"nested", "nested"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, tag := repoPath, "v1.0.0"
+			if tt.subdir != "" {
+				p, tag = repoPath+"/"+tt.subdir, tt.subdir+"/v1.0.0"
+			}
+			want := goModDownload(t, dir, env, p+"@v1.0.0")
+
+			var buf bytes.Buffer
+			err := Create(ctx, &buf, repo, module.Version{Path: p, Version: "v1.0.0"}, tag, tt.subdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum, err := Hash(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != want.Sum {
+				t.Errorf("Hash = %s, go mod download = %s", sum, want.Sum)
+			}
+
+			modFile := "go.mod"
+			if tt.subdir != "" {
+				modFile = tt.subdir + "/go.mod"
+			}
+			mod, err := repo.ReadFile(ctx, tag, modFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modSum, err := HashMod(mod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if modSum != want.GoModSum {
+				t.Errorf("HashMod = %s, go mod download = %s", modSum, want.GoModSum)
+			}
+		})
+	}
+}
+
+type downloaded struct {
+	Sum, GoModSum string
+}
+
+func goModDownload(t *testing.T, dir string, env []string, arg string) downloaded {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", "mod", "download", "-json", arg)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if err != nil {
+		t.Fatalf("go mod download %s: %v\n%s%s", arg, err, stdout.Bytes(), stderr.Bytes())
+	}
+	var d downloaded
+	err = json.Unmarshal(stdout.Bytes(), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// goEnv is an environment for the go command to fetch directly from the fixture
+func goEnv(t *testing.T, dir, repoDir string) []string {
+	t.Helper()
+	gitConfig := filepath.Join(dir, "gitconfig")
+	err := ioutil.WriteFile(gitConfig, []byte(`[url "`+repoDir+`"]
+	insteadOf = https://vanity.test/repo
+[protocol "file"]
+	allow = always
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "GO") || strings.HasPrefix(kv, "GIT_") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env,
+		"GIT_CONFIG_GLOBAL="+gitConfig,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GO111MODULE=on",
+		"GOFLAGS=-modcacherw",
+		"GOMODCACHE="+filepath.Join(dir, "modcache"),
+		"GOPATH="+filepath.Join(dir, "gopath"),
+		"GOCACHE="+filepath.Join(dir, "gocache"),
+		"GOPROXY=direct",
+		"GOPRIVATE=vanity.test",
+		"GOTOOLCHAIN=local",
+	)
+}
+
+func git(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	// keep line endings as written
+	cmd := exec.Command("git", append([]string{"-c", "core.autocrlf=false"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@vanity.test",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@vanity.test",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+// Package proxycache is a pull-through cache in front of an upstream module proxy.
+//
+// The immutable .info, .mod and .zip files of canonical versions
+// are stored on disk by the sha256 of their content,
+// verified on every read, and evicted least recently used first
+// once the cache grows past its size limit.
+// Everything else, such as version lists, is forwarded as is.
+package proxycache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// fetchTimeout bounds a single upstream download,
+	// which is shared by all requests waiting on it
+	fetchTimeout = 10 * time.Minute
+	// gcInterval is how often the cache size is checked
+	gcInterval = time.Minute
+	// maxErrorBody is the most of an upstream error response that's passed on
+	maxErrorBody = 64 << 10
+)
+
+// Cache is an on-disk pull-through cache of an upstream module proxy.
+//
+// Files are stored in dir/blobs/<hash[:2]>/<hash>,
+// with dir/refs/<module>/@v/<version>.<ext> holding the hash of its content
+// and recording the last use in its modification time,
+// so the cache survives restarts.
+type Cache struct {
+	dir      string
+	upstream string
+	maxSize  int64
+	client   *http.Client
+
+	mu       sync.Mutex
+	entries  map[string]*entry // by request path
+	blobs    map[string]*blob  // by content hash
+	size     int64             // total size of blobs
+	inflight map[string]*call  // upstream fetches by request path
+
+	gc chan struct{}
+}
+
+type entry struct {
+	hash string
+	used time.Time
+}
+
+type blob struct {
+	size int64
+	refs int
+}
+
+// call is an upstream fetch shared by concurrent requests for the same file
+type call struct {
+	done chan struct{}
+	res  result
+}
+
+type result struct {
+	hash string
+	// status and body are the upstream response if it wasn't a success
+	status int
+	body   []byte
+	err    error
+}
+
+// Open opens or creates a cache in dir for the proxy at upstream,
+// holding up to maxSize bytes.
+func Open(dir, upstream string, maxSize int64) (*Cache, error) {
+	for _, d := range []string{"blobs", "refs", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, d), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &Cache{
+		dir:      dir,
+		upstream: strings.TrimSuffix(upstream, "/"),
+		maxSize:  maxSize,
+		client:   &http.Client{},
+		entries:  make(map[string]*entry),
+		blobs:    make(map[string]*blob),
+		inflight: make(map[string]*call),
+		gc:       make(chan struct{}, 1),
+	}
+	err := c.load()
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", dir, err)
+	}
+	return c, nil
+}
+
+// load reads the cache index from disk,
+// dropping leftovers from interrupted writes and evictions
+func (c *Cache) load() error {
+	tmp := filepath.Join(c.dir, "tmp")
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return err
+	}
+
+	refs := filepath.Join(c.dir, "refs")
+	err = filepath.Walk(refs, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(fp, ".tmp") {
+			return os.Remove(fp)
+		}
+		rel, err := filepath.Rel(refs, fp)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+		hash := strings.TrimSpace(string(b))
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			klog.InfoS("dropping malformed cache entry", "path", rel)
+			return os.Remove(fp)
+		}
+		b2, ok := c.blobs[hash]
+		if !ok {
+			bi, err := os.Stat(c.blobPath(hash))
+			if err != nil {
+				klog.InfoS("dropping dangling cache entry", "path", rel, "err", err)
+				return os.Remove(fp)
+			}
+			b2 = &blob{size: bi.Size()}
+			c.blobs[hash] = b2
+			c.size += b2.size
+		}
+		b2.refs++
+		c.entries[filepath.ToSlash(rel)] = &entry{
+			hash: hash,
+			used: fi.ModTime(),
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	blobs := filepath.Join(c.dir, "blobs")
+	return filepath.Walk(blobs, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if _, ok := c.blobs[fi.Name()]; !ok {
+			return os.Remove(fp)
+		}
+		return nil
+	})
+}
+
+// Run evicts files once the cache is over its size limit,
+// until ctx is done
+func (c *Cache) Run(ctx context.Context) {
+	t := time.NewTicker(gcInterval)
+	defer t.Stop()
+	for {
+		c.evict()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-c.gc:
+		}
+	}
+}
+
+// evict removes the least recently used files until the cache fits in maxSize
+func (c *Cache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= c.maxSize {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].used.Before(c.entries[keys[j]].used)
+	})
+	before := c.size
+	var n int
+	for _, k := range keys {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.remove(k)
+		n++
+	}
+	klog.InfoS("evicted from cache", "files", n, "bytes", before-c.size)
+}
+
+// Serve handles a module proxy protocol request from goproxy.Split,
+// modPath is the escaped module path.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, modPath, req string) {
+	// keys are used as file names
+	if _, err := module.UnescapePath(modPath); err != nil {
+		http.Error(w, "invalid module path", http.StatusBadRequest)
+		return
+	}
+	key := modPath + req
+	if !cacheable(req) {
+		c.forward(w, r, key)
+		return
+	}
+
+	f, ok, err := c.open(key)
+	if err != nil {
+		// the cached file may be fine, leave it and serve this one from upstream
+		klog.ErrorS(err, "read cached file", "path", key)
+		c.forward(w, r, key)
+		return
+	} else if ok {
+		defer f.Close()
+		serveFile(w, r, key, f)
+		return
+	}
+
+	res := c.fetch(key)
+	if res.err != nil {
+		klog.ErrorS(res.err, "fetch from upstream", "path", key)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	} else if res.status != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+		return
+	}
+	f, err = c.openBlob(res.hash)
+	if err != nil {
+		klog.ErrorS(err, "read fetched file", "path", key)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	serveFile(w, r, key, f)
+}
+
+// cacheable reports whether a request is for an immutable file:
+// the .info, .mod or .zip of a canonical version
+func cacheable(req string) bool {
+	if !strings.HasPrefix(req, "/@v/") {
+		return false
+	}
+	req = strings.TrimPrefix(req, "/@v/")
+	ext := path.Ext(req)
+	switch ext {
+	case ".info", ".mod", ".zip":
+	default:
+		return false
+	}
+	v, err := module.UnescapeVersion(strings.TrimSuffix(req, ext))
+	return err == nil && module.CanonicalVersion(v) == v
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, key string, f *os.File) {
+	switch path.Ext(key) {
+	case ".info":
+		w.Header().Set("Content-Type", "application/json")
+	case ".mod":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case ".zip":
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// forward passes a request through to upstream uncached
+func (c *Cache) forward(w http.ResponseWriter, r *http.Request, key string) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, c.upstream+"/"+key, nil)
+	if err != nil {
+		klog.ErrorS(err, "create upstream request", "path", key)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		klog.ErrorS(err, "forward to upstream", "path", key)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+// open finds a cached file, marking it as used.
+// Files that are gone or fail their integrity check are dropped,
+// other errors leave the file in place.
+func (c *Cache) open(key string) (*os.File, bool, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		e.used = time.Now()
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	f, err := c.openBlob(e.hash)
+	if errors.Is(err, errHashMismatch) || errors.Is(err, os.ErrNotExist) {
+		if errors.Is(err, errHashMismatch) {
+			// evicted between the lookup and here is fine, corrupted isn't
+			klog.ErrorS(err, "drop cached file", "path", key)
+		}
+		c.mu.Lock()
+		c.removeBlob(e.hash)
+		c.mu.Unlock()
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	os.Chtimes(c.refPath(key), now, now)
+	return f, true, nil
+}
+
+// errHashMismatch is returned for stored files that no longer match their hash
+var errHashMismatch = errors.New("content hash mismatch")
+
+// openBlob opens a stored file after checking its content still matches its hash
+func (c *Cache) openBlob(hash string) (*os.File, error) {
+	f, err := os.Open(c.blobPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err == nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != hash {
+			err = fmt.Errorf("blob %s: %w: %s", hash, errHashMismatch, got)
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetch downloads a file from upstream into the cache,
+// sharing the download with concurrent requests for the same file
+func (c *Cache) fetch(key string) result {
+	c.mu.Lock()
+	if cl, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		return cl.res
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	// not bound to any single request, others may be waiting on it
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	cl.res = c.download(ctx, key)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(cl.done)
+	return cl.res
+}
+
+func (c *Cache) download(ctx context.Context, key string) result {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.upstream+"/"+key, nil)
+	if err != nil {
+		return result{err: err}
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return result{err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		return result{status: res.StatusCode, body: body}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(c.dir, "tmp"), "fetch-")
+	if err != nil {
+		return result{err: err}
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(res.Body, modzip.MaxZipFile+1))
+	if err != nil {
+		return result{err: fmt.Errorf("download %s: %w", key, err)}
+	} else if n > modzip.MaxZipFile {
+		return result{err: fmt.Errorf("download %s: too large", key)}
+	}
+	err = tmp.Close()
+	if err != nil {
+		return result{err: err}
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	err = c.put(key, tmp.Name(), hash, n)
+	if err != nil {
+		return result{err: fmt.Errorf("store %s: %w", key, err)}
+	}
+	return result{hash: hash}
+}
+
+// put moves a downloaded file into the cache
+func (c *Cache) put(key, tmp, hash string, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && e.hash == hash {
+		// fetched again by a request that missed the cache
+		// before an earlier fetch finished
+		e.used = time.Now()
+		os.Chtimes(c.refPath(key), e.used, e.used)
+		return nil
+	}
+
+	b, ok := c.blobs[hash]
+	if !ok {
+		bp := c.blobPath(hash)
+		err := os.MkdirAll(filepath.Dir(bp), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, bp)
+		if err != nil {
+			return err
+		}
+		b = &blob{size: size}
+		c.blobs[hash] = b
+		c.size += size
+	}
+	// referenced before dropping an old entry, which may share the blob
+	b.refs++
+	c.remove(key)
+
+	rp := c.refPath(key)
+	err := os.MkdirAll(filepath.Dir(rp), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(rp+".tmp", []byte(hash+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Rename(rp+".tmp", rp)
+	}
+	if err != nil {
+		c.release(hash)
+		return err
+	}
+	c.entries[key] = &entry{
+		hash: hash,
+		used: time.Now(),
+	}
+
+	if c.size > c.maxSize {
+		select {
+		case c.gc <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// remove drops a file from the cache,
+// and its content if nothing else refers to it.
+// callers must hold mu.
+func (c *Cache) remove(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	delete(c.entries, key)
+	err := os.Remove(c.refPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		klog.ErrorS(err, "remove cache entry", "path", key)
+	}
+	c.release(e.hash)
+}
+
+// release drops a reference to stored content,
+// removing it once nothing refers to it.
+// callers must hold mu.
+func (c *Cache) release(hash string) {
+	b, ok := c.blobs[hash]
+	if !ok {
+		return
+	}
+	b.refs--
+	if b.refs > 0 {
+		return
+	}
+	delete(c.blobs, hash)
+	c.size -= b.size
+	err := os.Remove(c.blobPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		klog.ErrorS(err, "remove cached file", "hash", hash)
+	}
+}
+
+// removeBlob drops a stored file and everything referring to it.
+// callers must hold mu.
+func (c *Cache) removeBlob(hash string) {
+	for k, e := range c.entries {
+		if e.hash == hash {
+			c.remove(k)
+		}
+	}
+}
+
+func (c *Cache) blobPath(hash string) string {
+	return filepath.Join(c.dir, "blobs", hash[:2], hash)
+}
+
+// refPath is where the hash for a request path is stored,
+// escaped module paths and versions are safe to use as file names
+func (c *Cache) refPath(key string) string {
+	return filepath.Join(c.dir, "refs", filepath.FromSlash(key))
+}
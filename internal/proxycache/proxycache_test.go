@@ -0,0 +1,363 @@
+package proxycache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// upstream is a module proxy serving fixed files, counting requests
+type upstream struct {
+	mu    sync.Mutex
+	files map[string]string
+	hits  map[string]int
+	// block holds requests until closed, if set
+	block chan struct{}
+}
+
+func newUpstream(t *testing.T, files map[string]string) (*upstream, string) {
+	t.Helper()
+	u := &upstream{files: files, hits: make(map[string]int)}
+	srv := httptest.NewServer(u)
+	t.Cleanup(srv.Close)
+	return u, srv.URL
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.hits[r.URL.Path]++
+	f, ok := u.files[r.URL.Path]
+	block := u.block
+	u.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	if !ok {
+		http.Error(w, "not found: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(f))
+}
+
+func (u *upstream) count(p string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.hits[p]
+}
+
+func (u *upstream) set(p, content string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.files[p] = content
+}
+
+func open(t *testing.T, dir, url string, maxSize int64) *Cache {
+	t.Helper()
+	c, err := Open(dir, url, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// get requests a file through the cache
+func get(t *testing.T, c *Cache, modPath, req string) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/"+modPath+req, nil)
+	c.Serve(w, r, modPath, req)
+	return w.Code, w.Body.String()
+}
+
+func checkGet(t *testing.T, c *Cache, modPath, req, want string) {
+	t.Helper()
+	code, body := get(t, c, modPath, req)
+	if code != http.StatusOK || body != want {
+		t.Errorf("get %s%s = %d %q, want 200 %q", modPath, req, code, body, want)
+	}
+}
+
+// checkConsistent compares the in memory index with what's on disk
+func checkConsistent(t *testing.T, c *Cache) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var size int64
+	refs := make(map[string]int)
+	for k, e := range c.entries {
+		b, err := ioutil.ReadFile(c.refPath(k))
+		if err != nil || strings.TrimSpace(string(b)) != e.hash {
+			t.Errorf("ref %s = %q, %v, want %s", k, b, err, e.hash)
+		}
+		refs[e.hash]++
+	}
+	for hash, b := range c.blobs {
+		fi, err := os.Stat(c.blobPath(hash))
+		if err != nil || fi.Size() != b.size {
+			t.Errorf("blob %s: %v, want size %d", hash, err, b.size)
+		}
+		if b.refs != refs[hash] {
+			t.Errorf("blob %s has %d refs, want %d", hash, b.refs, refs[hash])
+		}
+		size += b.size
+	}
+	for hash := range refs {
+		if _, ok := c.blobs[hash]; !ok {
+			t.Errorf("entries refer to missing blob %s", hash)
+		}
+	}
+	if size != c.size {
+		t.Errorf("size = %d, want %d", c.size, size)
+	}
+}
+
+func TestHit(t *testing.T) {
+	u, url := newUpstream(t, map[string]string{
+		"/example.com/m/@v/v1.0.0.mod": "module example.com/m\n",
+		"/example.com/m/@v/list":       "v1.0.0\n",
+	})
+	dir := t.TempDir()
+	c := open(t, dir, url, 1<<20)
+
+	for i := 0; i < 3; i++ {
+		checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+	}
+	if n := u.count("/example.com/m/@v/v1.0.0.mod"); n != 1 {
+		t.Errorf("upstream got %d requests for a cached file, want 1", n)
+	}
+
+	// lists change, they're always forwarded
+	for i := 0; i < 2; i++ {
+		checkGet(t, c, "example.com/m", "/@v/list", "v1.0.0\n")
+	}
+	if n := u.count("/example.com/m/@v/list"); n != 2 {
+		t.Errorf("upstream got %d requests for list, want 2", n)
+	}
+	checkConsistent(t, c)
+
+	// survives a restart
+	c = open(t, dir, url, 1<<20)
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+	if n := u.count("/example.com/m/@v/v1.0.0.mod"); n != 1 {
+		t.Errorf("upstream got %d requests after restart, want 1", n)
+	}
+	checkConsistent(t, c)
+}
+
+func TestMiss(t *testing.T) {
+	u, url := newUpstream(t, map[string]string{})
+	c := open(t, t.TempDir(), url, 1<<20)
+
+	for i := 0; i < 2; i++ {
+		code, body := get(t, c, "example.com/m", "/@v/v1.0.0.info")
+		if code != http.StatusNotFound || !strings.Contains(body, "not found") {
+			t.Errorf("get missing file = %d %q, want upstream 404", code, body)
+		}
+	}
+	// errors aren't cached
+	if n := u.count("/example.com/m/@v/v1.0.0.info"); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+
+	u.set("/example.com/m/@v/v1.0.0.info", `{"Version":"v1.0.0"}`)
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.info", `{"Version":"v1.0.0"}`)
+
+	code, _ := get(t, c, "Example.com/m", "/@v/v1.0.0.info")
+	if code != http.StatusBadRequest {
+		t.Errorf("get with invalid module path = %d, want 400", code)
+	}
+	checkConsistent(t, c)
+}
+
+func TestEvict(t *testing.T) {
+	files := map[string]string{
+		"/example.com/a/@v/v1.0.0.zip": strings.Repeat("a", 100),
+		"/example.com/b/@v/v1.0.0.zip": strings.Repeat("b", 100),
+		"/example.com/c/@v/v1.0.0.zip": strings.Repeat("c", 100),
+		// same content as a
+		"/example.com/d/@v/v1.0.0.zip": strings.Repeat("a", 100),
+	}
+	u, url := newUpstream(t, files)
+	dir := t.TempDir()
+	c := open(t, dir, url, 250)
+
+	for _, m := range []string{"a", "b", "d"} {
+		checkGet(t, c, "example.com/"+m, "/@v/v1.0.0.zip", files["/example.com/"+m+"/@v/v1.0.0.zip"])
+	}
+	// a and d share their content
+	if c.size != 200 {
+		t.Errorf("size = %d, want 200", c.size)
+	}
+	// a is used again, b is the least recently used
+	checkGet(t, c, "example.com/a", "/@v/v1.0.0.zip", files["/example.com/a/@v/v1.0.0.zip"])
+	checkGet(t, c, "example.com/c", "/@v/v1.0.0.zip", files["/example.com/c/@v/v1.0.0.zip"])
+	c.evict()
+	checkConsistent(t, c)
+	if c.size > 250 {
+		t.Errorf("size after evict = %d, want at most 250", c.size)
+	}
+	if _, ok := c.entries["example.com/b/@v/v1.0.0.zip"]; ok {
+		t.Error("least recently used file wasn't evicted")
+	}
+	for _, m := range []string{"a", "c", "d"} {
+		if _, ok := c.entries["example.com/"+m+"/@v/v1.0.0.zip"]; !ok {
+			t.Errorf("%s was evicted", m)
+		}
+	}
+
+	// evicted files are fetched again
+	checkGet(t, c, "example.com/b", "/@v/v1.0.0.zip", files["/example.com/b/@v/v1.0.0.zip"])
+	if n := u.count("/example.com/b/@v/v1.0.0.zip"); n != 2 {
+		t.Errorf("upstream got %d requests for evicted file, want 2", n)
+	}
+
+	c = open(t, dir, url, 250)
+	checkConsistent(t, c)
+}
+
+func TestCorrupt(t *testing.T) {
+	u, url := newUpstream(t, map[string]string{
+		"/example.com/m/@v/v1.0.0.mod": "module example.com/m\n",
+		"/example.com/n/@v/v1.0.0.mod": "module example.com/m\n",
+	})
+	c := open(t, t.TempDir(), url, 1<<20)
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+	checkGet(t, c, "example.com/n", "/@v/v1.0.0.mod", "module example.com/m\n")
+
+	hash := c.entries["example.com/m/@v/v1.0.0.mod"].hash
+	err := ioutil.WriteFile(c.blobPath(hash), []byte("module evil.example\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dropped, along with everything sharing it, and fetched again
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+	if n := u.count("/example.com/m/@v/v1.0.0.mod"); n != 2 {
+		t.Errorf("upstream got %d requests after corruption, want 2", n)
+	}
+	if _, ok := c.entries["example.com/n/@v/v1.0.0.mod"]; ok {
+		t.Error("entry sharing the corrupt blob wasn't dropped")
+	}
+	checkConsistent(t, c)
+}
+
+func TestUnreadable(t *testing.T) {
+	u, url := newUpstream(t, map[string]string{
+		"/example.com/m/@v/v1.0.0.mod": "module example.com/m\n",
+	})
+	c := open(t, t.TempDir(), url, 1<<20)
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+
+	// a read error that isn't about the content, without relying on permissions
+	hash := c.entries["example.com/m/@v/v1.0.0.mod"].hash
+	fn := c.blobPath(hash)
+	err := os.Rename(fn, fn+".tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(fn, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// served from upstream, the cached file stays
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+	if n := u.count("/example.com/m/@v/v1.0.0.mod"); n != 2 {
+		t.Errorf("upstream got %d requests while unreadable, want 2", n)
+	}
+	if fi, err := os.Stat(fn); err != nil || !fi.IsDir() {
+		t.Fatal("cached file removed on a read error")
+	}
+	if _, ok := c.entries["example.com/m/@v/v1.0.0.mod"]; !ok {
+		t.Fatal("entry dropped on a read error")
+	}
+
+	// readable again
+	err = os.Remove(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(fn+".tmp", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.mod", "module example.com/m\n")
+	if n := u.count("/example.com/m/@v/v1.0.0.mod"); n != 2 {
+		t.Errorf("upstream got %d requests after the file was readable again, want 2", n)
+	}
+	checkConsistent(t, c)
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	u, url := newUpstream(t, map[string]string{
+		"/example.com/m/@v/v1.0.0.zip": "zip",
+	})
+	u.block = make(chan struct{})
+	c := open(t, t.TempDir(), url, 1<<20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkGet(t, c, "example.com/m", "/@v/v1.0.0.zip", "zip")
+		}()
+	}
+	// wait for the download to start before letting it finish
+	for u.count("/example.com/m/@v/v1.0.0.zip") == 0 {
+		runtime.Gosched()
+	}
+	close(u.block)
+	wg.Wait()
+	if n := u.count("/example.com/m/@v/v1.0.0.zip"); n != 1 {
+		t.Errorf("upstream got %d requests, want 1 shared fetch", n)
+	}
+	checkConsistent(t, c)
+}
+
+// TestFetchAgain is a request that missed the cache
+// fetching a file after an earlier fetch already stored it
+func TestFetchAgain(t *testing.T) {
+	u, url := newUpstream(t, map[string]string{
+		"/example.com/m/@v/v1.0.0.zip": "zip",
+	})
+	c := open(t, t.TempDir(), url, 1<<20)
+	for i := 0; i < 2; i++ {
+		res := c.fetch("example.com/m/@v/v1.0.0.zip")
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		f, err := c.openBlob(res.hash)
+		if err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+		f.Close()
+	}
+	if c.size != 3 || len(c.blobs) != 1 {
+		t.Errorf("size = %d, blobs = %d, want 3, 1", c.size, len(c.blobs))
+	}
+	checkConsistent(t, c)
+
+	// changed upstream content replaces the old
+	u.set("/example.com/m/@v/v1.0.0.zip", "other zip")
+	res := c.fetch("example.com/m/@v/v1.0.0.zip")
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	checkGet(t, c, "example.com/m", "/@v/v1.0.0.zip", "other zip")
+	if c.size != 9 || len(c.blobs) != 1 {
+		t.Errorf("size = %d, blobs = %d, want 9, 1", c.size, len(c.blobs))
+	}
+	checkConsistent(t, c)
+
+	entries, err := ioutil.ReadDir(filepath.Join(c.dir, "tmp"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("leftover temporary files: %v, %v", entries, err)
+	}
+}
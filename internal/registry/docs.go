@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDocs        = "https://pkg.go.dev"
+	defaultDocsRefresh = "5s"
+)
+
+// docs is a parsed documentation config
+type docs struct {
+	// base is the url of the site, empty for none
+	base string
+	site string
+	// refresh is the delay in seconds, negative for none
+	refresh int
+}
+
+func parseDocs(base, refresh string) (docs, error) {
+	var d docs
+	if base != "none" {
+		u, err := url.Parse(base)
+		if err != nil {
+			return d, fmt.Errorf("docs: %w", err)
+		} else if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return d, fmt.Errorf("docs %q: not an http(s) url or none", base)
+		}
+		d.base, d.site = strings.TrimSuffix(base, "/"), u.Host
+	}
+
+	d.refresh = -1
+	if refresh != "off" {
+		dur, err := time.ParseDuration(refresh)
+		if err != nil {
+			return d, fmt.Errorf("docs_refresh: %w", err)
+		} else if dur < 0 {
+			return d, fmt.Errorf("docs_refresh %q: negative", refresh)
+		}
+		d.refresh = int(dur / time.Second)
+	}
+	return d, nil
+}
+
+// DocsURL is the documentation page of the module,
+// empty if documentation is disabled
+func (m *Module) DocsURL() string {
+	return m.DocsURLFor(m.Path)
+}
+
+// DocsURLFor is the documentation page of a package in the module,
+// empty if documentation is disabled
+func (m *Module) DocsURLFor(p string) string {
+	if m.docs.base == "" {
+		return ""
+	}
+	return m.docs.base + "/" + p
+}
+
+// DocsSite is the name of the documentation site, eg pkg.go.dev
+func (m *Module) DocsSite() string {
+	return m.docs.site
+}
+
+// DocsRefreshMeta is the content of the meta refresh tag sending the module page
+// to the documentation, empty if there shouldn't be one
+func (m *Module) DocsRefreshMeta() string {
+	if m.docs.base == "" || m.docs.refresh < 0 {
+		return ""
+	}
+	return strconv.Itoa(m.docs.refresh) + ";url=" + m.DocsURL()
+}
@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Forge describes the source browsing urls of a code hosting site.
+// Patterns may use {repo} for the repository url, {branch} for the branch,
+// and the go-source placeholders {dir}, {/dir}, {file} and {line}.
+type Forge struct {
+	Dir  string `json:"dir"`
+	File string `json:"file"`
+}
+
+var forges = map[string]Forge{
+	"github": {
+		Dir:  "{repo}/tree/{branch}{/dir}",
+		File: "{repo}/blob/{branch}{/dir}/{file}#L{line}",
+	},
+	"gitlab": {
+		Dir:  "{repo}/-/tree/{branch}{/dir}",
+		File: "{repo}/-/blob/{branch}{/dir}/{file}#L{line}",
+	},
+	"gitea": {
+		Dir:  "{repo}/src/branch/{branch}{/dir}",
+		File: "{repo}/src/branch/{branch}{/dir}/{file}#L{line}",
+	},
+	"bitbucket": {
+		Dir:  "{repo}/src/{branch}{/dir}",
+		File: "{repo}/src/{branch}{/dir}/{file}#lines-{line}",
+	},
+	"sourcehut": {
+		Dir:  "{repo}/tree/{branch}/item{/dir}",
+		File: "{repo}/tree/{branch}/item{/dir}/{file}#L{line}",
+	},
+}
+
+// forgeHosts are the well known public instances of forges
+var forgeHosts = map[string]string{
+	"github.com":    "github",
+	"gitlab.com":    "gitlab",
+	"gitea.com":     "gitea",
+	"codeberg.org":  "gitea",
+	"bitbucket.org": "bitbucket",
+	"git.sr.ht":     "sourcehut",
+}
+
+// resolveForge picks the source url patterns for a module,
+// from its custom patterns, its named forge, or the host of its repo.
+// ok is false if no patterns apply.
+func resolveForge(m *Module) (f Forge, ok bool, err error) {
+	switch {
+	case m.Source != nil:
+		if m.Forge != "" && m.Forge != "custom" {
+			return Forge{}, false, fmt.Errorf("source patterns set with forge %q", m.Forge)
+		}
+		if m.Source.Dir == "" || m.Source.File == "" {
+			return Forge{}, false, fmt.Errorf("source patterns need both dir and file")
+		}
+		return *m.Source, true, nil
+	case m.Forge == "custom":
+		return Forge{}, false, fmt.Errorf("custom forge without source patterns")
+	case m.Forge != "":
+		f, ok = forges[m.Forge]
+		if !ok {
+			return Forge{}, false, fmt.Errorf("unknown forge %q", m.Forge)
+		}
+		return f, true, nil
+	}
+
+	u, err := url.Parse(m.Repo)
+	if err != nil {
+		return Forge{}, false, nil
+	}
+	name, ok := forgeHosts[u.Hostname()]
+	if !ok {
+		return Forge{}, false, nil
+	}
+	return forges[name], true, nil
+}
+
+func (f Forge) expand(repo, branch, subdir string) Forge {
+	dir, slashDir := "{dir}", "{/dir}"
+	if subdir != "" {
+		// go-source dirs are relative to the module root
+		dir, slashDir = subdir+"/{dir}", "/"+subdir+"{/dir}"
+	}
+	r := strings.NewReplacer(
+		"{repo}", strings.TrimSuffix(repo, ".git"),
+		"{branch}", branch,
+		"{dir}", dir,
+		"{/dir}", slashDir,
+	)
+	return Forge{
+		Dir:  r.Replace(f.Dir),
+		File: r.Replace(f.File),
+	}
+}
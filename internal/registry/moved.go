@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// Move is a module path that has been renamed or removed
+type Move struct {
+	// Path is the old module path, including everything under it
+	Path string `json:"path"`
+	// To is the new module path, browsers are redirected there
+	To string `json:"to"`
+	// Error is the message for the go command,
+	// defaults to one pointing at To
+	Error string `json:"error"`
+
+	// target is the module at To, if it's one of ours
+	target *Module
+}
+
+func (h *Host) initMoved(r *Registry) error {
+	h.byMoved = make(map[string]*Move, len(h.Moved))
+	for i, mv := range h.Moved {
+		switch {
+		case mv.Path == "":
+			return fmt.Errorf("moved %d: no path", i)
+		case !strings.HasPrefix(mv.Path, h.Name+"/"):
+			return fmt.Errorf("moved %s: not under host %s", mv.Path, h.Name)
+		case mv.To == "" && mv.Error == "":
+			return fmt.Errorf("moved %s: needs to or error", mv.Path)
+		case h.byPath[mv.Path] != nil:
+			return fmt.Errorf("moved %s: is also a module", mv.Path)
+		case h.byMoved[mv.Path] != nil:
+			return fmt.Errorf("moved %s: duplicate", mv.Path)
+		}
+		err := module.CheckPath(mv.Path)
+		if err != nil {
+			return fmt.Errorf("moved %s: %w", mv.Path, err)
+		}
+		if mv.To != "" {
+			err = module.CheckPath(mv.To)
+			if err != nil {
+				return fmt.Errorf("moved %s: to: %w", mv.Path, err)
+			}
+			if m, ok := r.Lookup(mv.To); ok && m.Path == mv.To && !m.Proxy && !m.IsProxy() {
+				mv.target = m
+			}
+		}
+		h.byMoved[mv.Path] = mv
+	}
+	return nil
+}
+
+// GoImport is the content of the go-import meta tag for the old path,
+// pointing at the repository of the new module,
+// so versions from before the move keep working.
+// ok is false if the new module isn't one of ours,
+// or if the go command should get Error instead.
+func (mv *Move) GoImport() (string, bool) {
+	if mv.target == nil || mv.Error != "" {
+		return "", false
+	}
+	s := mv.Path + " " + mv.target.VCS + " " + mv.target.Repo
+	if mv.target.Subdir != "" {
+		s += " " + mv.target.Subdir
+	}
+	return s, true
+}
+
+// Message is the error for the go command
+func (mv *Move) Message() string {
+	if mv.Error != "" {
+		return mv.Error
+	}
+	return mv.Path + " has moved to " + mv.To
+}
+
+// URL is where browsers are redirected to for an import path under Path,
+// empty if there's nowhere to go
+func (mv *Move) URL(p string) string {
+	if mv.To == "" {
+		return ""
+	}
+	return "https://" + mv.To + strings.TrimPrefix(p, mv.Path)
+}
+
+// LookupMoved finds the move covering a full import path,
+// matching the longest old path that is a prefix of it.
+func (h *Host) LookupMoved(p string) (*Move, bool) {
+	for ; p != h.Name && p != "." && p != "/"; p = path.Dir(p) {
+		if mv, ok := h.byMoved[p]; ok {
+			return mv, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,431 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// Registry is the set of vanity hosts served,
+// loaded from a JSON config file.
+type Registry struct {
+	Hosts []*Host `json:"hosts"`
+
+	byName map[string]*Host
+}
+
+// Host is a vanity domain and the modules it serves.
+type Host struct {
+	// Name is the domain, matched against the Host header
+	Name string `json:"host"`
+	// Branch is the default branch for modules, defaults to master
+	Branch string `json:"branch"`
+	// Docs is the documentation site, such as a self-hosted pkgsite,
+	// defaults to https://pkg.go.dev, none disables documentation links
+	Docs string `json:"docs"`
+	// DocsRefresh is how long module pages wait before refreshing to the documentation,
+	// defaults to 5s, off disables the refresh
+	DocsRefresh string `json:"docs_refresh"`
+	// DocsRedirect sends browsers to the documentation
+	// instead of rendering a module page
+	DocsRedirect bool `json:"docs_redirect"`
+	// Redirect sends requests for the root to a url
+	// instead of rendering the module index
+	Redirect string `json:"redirect"`
+	// RepoPrefix serves <host>/<name> from the repo <RepoPrefix><name>
+	// for paths that don't match a listed module
+	RepoPrefix string `json:"repo_prefix"`
+	// Template is a file with html/template definitions
+	// overriding the builtin "module", "index", "head" and "footer" templates
+	Template string    `json:"template"`
+	Branding Branding  `json:"branding"`
+	Scan     *Scan     `json:"scan"`
+	Modules  []*Module `json:"modules"`
+	// Moved are module paths that no longer exist
+	Moved []*Move `json:"moved"`
+
+	byPath  map[string]*Module
+	byMoved map[string]*Move
+}
+
+// Branding customizes the builtin templates
+type Branding struct {
+	// Home is the canonical link of the site
+	Home string `json:"home"`
+	// Icon is the url of a square png icon
+	Icon string `json:"icon"`
+	// Links are shown in the footer
+	Links []Link `json:"links"`
+}
+
+// Link is a named url
+type Link struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Scan adds a module for every git repository in a directory
+type Scan struct {
+	// Dir holds the repositories, named <name> or <name>.git,
+	// served as <host>/<name>
+	Dir string `json:"dir"`
+	// RepoPrefix is prepended to the name to form the repo url
+	RepoPrefix string `json:"repo_prefix"`
+}
+
+// Module is a single published module.
+type Module struct {
+	// Path is the full import path, eg go.seankhliao.com/vanity
+	Path string `json:"path"`
+	// VCS is the version control system of Repo,
+	// one of git, hg, svn, bzr, fossil or mod.
+	// Defaults to git.
+	VCS string `json:"vcs"`
+	// Repo is the url of the repository,
+	// or of the GOPROXY serving the module when VCS is mod
+	Repo string `json:"repo"`
+	// Subdir is the directory within Repo holding the module
+	Subdir string `json:"subdir"`
+	// Forge is the code hosting site of Repo, used for source links,
+	// one of github, gitlab, gitea, bitbucket, sourcehut or custom.
+	// Defaults to one inferred from the host of Repo.
+	Forge string `json:"forge"`
+	// Source are url patterns for a custom forge
+	Source *Forge `json:"source"`
+	// Branch is the branch source links point to,
+	// defaults to the host Branch
+	Branch string `json:"branch"`
+	// Local is the path to a local clone of the repository,
+	// used to find versions
+	Local string `json:"local"`
+	// Proxy serves the module from Local over the module proxy protocol
+	// and points the go command at it
+	Proxy bool `json:"proxy"`
+	// Docs is the documentation site, defaults to the host Docs
+	Docs string `json:"docs"`
+	// DocsRefresh is the module page refresh delay, defaults to the host DocsRefresh
+	DocsRefresh string `json:"docs_refresh"`
+
+	// metadata
+	Description string `json:"description"`
+
+	source    Forge
+	hasSource bool
+	fallback  bool
+	proxyURL  string
+	docs      docs
+}
+
+// vcsTypes are the values the go command accepts in go-import tags
+var vcsTypes = map[string]bool{
+	"git":    true,
+	"hg":     true,
+	"svn":    true,
+	"bzr":    true,
+	"fossil": true,
+	"mod":    true,
+}
+
+// GoImport is the content of the go-import meta tag
+func (m *Module) GoImport() string {
+	if m.Proxy {
+		return m.Path + " mod " + m.proxyURL
+	}
+	return m.GoImportRepo(m.Repo)
+}
+
+// GoImportRepo is the content of the go-import meta tag
+// pointing to another copy of Repo, such as a mirror
+func (m *Module) GoImportRepo(repo string) string {
+	s := m.Path + " " + m.VCS + " " + repo
+	if m.Subdir != "" {
+		s += " " + m.Subdir
+	}
+	return s
+}
+
+// GoSource is the content of the go-source meta tag,
+// empty if the source urls aren't known
+func (m *Module) GoSource() string {
+	if !m.hasSource {
+		return ""
+	}
+	home := strings.TrimSuffix(m.Repo, ".git")
+	return m.Path + " " + home + " " + m.source.Dir + " " + m.source.File
+}
+
+// SourceURL is the link to browse the module source,
+// falling back to the repo
+func (m *Module) SourceURL() string {
+	if !m.hasSource {
+		return m.Repo
+	}
+	return strings.NewReplacer("{dir}", "", "{/dir}", "").Replace(m.source.Dir)
+}
+
+// IsFallback reports whether the module isn't listed,
+// but derived from the host RepoPrefix
+func (m *Module) IsFallback() bool {
+	return m.fallback
+}
+
+// IsProxy reports whether the module is only available through a module proxy
+func (m *Module) IsProxy() bool {
+	return m.VCS == "mod"
+}
+
+// Load reads and validates a registry from a config file.
+// A config without a hosts key is read as a single host.
+// Unknown fields are an error.
+func Load(fn string) (*Registry, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", fn, err)
+	}
+	var keys map[string]json.RawMessage
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", fn, err)
+	}
+	var r Registry
+	if _, ok := keys["hosts"]; ok {
+		err = decodeStrict(b, &r)
+	} else {
+		var h Host
+		err = decodeStrict(b, &h)
+		r.Hosts = []*Host{&h}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", fn, err)
+	} else if len(r.Hosts) == 0 {
+		return nil, fmt.Errorf("decode %s: no hosts", fn)
+	}
+	err = r.init()
+	if err != nil {
+		return nil, fmt.Errorf("validate %s: %w", fn, err)
+	}
+	return &r, nil
+}
+
+// decodeStrict decodes JSON, rejecting unknown fields
+// so typos in the config don't go unnoticed
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func (r *Registry) init() error {
+	r.byName = make(map[string]*Host, len(r.Hosts))
+	for i, h := range r.Hosts {
+		switch {
+		case h.Name == "":
+			return fmt.Errorf("host %d: no name", i)
+		case r.byName[h.Name] != nil:
+			return fmt.Errorf("host %s: duplicate", h.Name)
+		}
+		err := h.init()
+		if err != nil {
+			return fmt.Errorf("host %s: %w", h.Name, err)
+		}
+		r.byName[h.Name] = h
+	}
+	for _, h := range r.Hosts {
+		err := h.initMoved(r)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// Lookup finds the module for a full import path on any host
+func (r *Registry) Lookup(p string) (*Module, bool) {
+	name := p
+	if i := strings.Index(p, "/"); i >= 0 {
+		name = p[:i]
+	}
+	h, ok := r.byName[name]
+	if !ok {
+		return nil, false
+	}
+	return h.Lookup(p)
+}
+
+// Host finds the config for a request Host header
+func (r *Registry) Host(name string) (*Host, bool) {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	h, ok := r.byName[strings.ToLower(name)]
+	return h, ok
+}
+
+func (h *Host) init() error {
+	h.Name = strings.ToLower(h.Name)
+	if h.Branch == "" {
+		h.Branch = "master"
+	}
+	if h.Docs == "" {
+		h.Docs = defaultDocs
+	}
+	if h.DocsRefresh == "" {
+		h.DocsRefresh = defaultDocsRefresh
+	}
+	if h.Scan != nil {
+		err := h.scan()
+		if err != nil {
+			return fmt.Errorf("scan %s: %w", h.Scan.Dir, err)
+		}
+	}
+	h.byPath = make(map[string]*Module, len(h.Modules))
+	for i, m := range h.Modules {
+		switch {
+		case m.Path == "":
+			return fmt.Errorf("module %d: no path", i)
+		case !strings.HasPrefix(m.Path, h.Name+"/"):
+			return fmt.Errorf("module %s: not under host %s", m.Path, h.Name)
+		case m.Repo == "":
+			return fmt.Errorf("module %s: no repo", m.Path)
+		case h.byPath[m.Path] != nil:
+			return fmt.Errorf("module %s: duplicate", m.Path)
+		}
+		err := h.initModule(m)
+		if err != nil {
+			return err
+		}
+		h.byPath[m.Path] = m
+	}
+	return nil
+}
+
+// initModule validates a module and fills in defaults from the host
+func (h *Host) initModule(m *Module) error {
+	err := module.CheckPath(m.Path)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", m.Path, err)
+	}
+	if m.VCS == "" {
+		m.VCS = "git"
+	}
+	if !vcsTypes[m.VCS] {
+		return fmt.Errorf("module %s: unknown vcs %q", m.Path, m.VCS)
+	}
+	if m.Subdir != "" {
+		switch {
+		case m.IsProxy():
+			return fmt.Errorf("module %s: subdir with vcs mod", m.Path)
+		case path.IsAbs(m.Subdir), path.Clean(m.Subdir) != m.Subdir, strings.HasPrefix(m.Subdir, ".."):
+			return fmt.Errorf("module %s: subdir %q not a clean relative path", m.Path, m.Subdir)
+		}
+	}
+	if m.Proxy {
+		switch {
+		case m.IsProxy():
+			return fmt.Errorf("module %s: proxy with vcs mod", m.Path)
+		case m.Local == "":
+			return fmt.Errorf("module %s: proxy without local", m.Path)
+		}
+		m.proxyURL = "https://" + h.Name
+	}
+	if m.Branch == "" {
+		m.Branch = h.Branch
+	}
+	if m.Docs == "" {
+		m.Docs = h.Docs
+	}
+	if m.DocsRefresh == "" {
+		m.DocsRefresh = h.DocsRefresh
+	}
+	m.docs, err = parseDocs(m.Docs, m.DocsRefresh)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", m.Path, err)
+	}
+	if !m.IsProxy() {
+		f, ok, err := resolveForge(m)
+		if err != nil {
+			return fmt.Errorf("module %s: %w", m.Path, err)
+		}
+		m.source, m.hasSource = f.expand(m.Repo, m.Branch, m.Subdir), ok
+	}
+	return nil
+}
+
+// scan adds modules for the repositories in the scan dir
+// and sets the local clone of already listed modules
+func (h *Host) scan() error {
+	fis, err := ioutil.ReadDir(h.Scan.Dir)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]*Module, len(h.Modules))
+	for _, m := range h.Modules {
+		listed[m.Path] = m
+	}
+	for _, fi := range fis {
+		dir := filepath.Join(h.Scan.Dir, fi.Name())
+		if !fi.IsDir() || !isGitDir(dir) {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".git")
+		p := path.Join(h.Name, name)
+		if m, ok := listed[p]; ok {
+			if m.Local == "" {
+				m.Local = dir
+			}
+			continue
+		}
+		if h.Scan.RepoPrefix == "" {
+			return fmt.Errorf("found %s but no repo_prefix", name)
+		}
+		h.Modules = append(h.Modules, &Module{
+			Path:  p,
+			Repo:  h.Scan.RepoPrefix + name,
+			Local: dir,
+		})
+	}
+	return nil
+}
+
+// isGitDir reports whether dir looks like a bare repository or a worktree
+func isGitDir(dir string) bool {
+	for _, fn := range []string{".git", "HEAD"} {
+		_, err := os.Stat(filepath.Join(dir, fn))
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup finds the module for a full import path,
+// matching the longest module path that is a prefix of it,
+// or the module for its first element under RepoPrefix.
+func (h *Host) Lookup(p string) (*Module, bool) {
+	for q := p; q != h.Name && q != "." && q != "/"; q = path.Dir(q) {
+		if m, ok := h.byPath[q]; ok {
+			return m, true
+		}
+	}
+	if h.RepoPrefix == "" || !strings.HasPrefix(p, h.Name+"/") {
+		return nil, false
+	}
+	name := strings.SplitN(strings.TrimPrefix(p, h.Name+"/"), "/", 2)[0]
+	m := &Module{
+		Path:     h.Name + "/" + name,
+		Repo:     h.RepoPrefix + name,
+		fallback: true,
+	}
+	if h.initModule(m) != nil {
+		return nil, false
+	}
+	return m, true
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, config string) *Registry {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "vanity.json")
+	err := ioutil.WriteFile(fn, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLoad(t *testing.T) {
+	r := load(t, `{"hosts": [{"host": "a.test"}, {"host": "b.test"}]}`)
+	if len(r.Hosts) != 2 {
+		t.Errorf("loaded %d hosts, want 2", len(r.Hosts))
+	}
+	r = load(t, `{"host": "a.test", "docs_redirect": true}`)
+	if len(r.Hosts) != 1 || !r.Hosts[0].DocsRedirect {
+		t.Errorf("single host config = %+v", r.Hosts)
+	}
+
+	for _, tt := range []struct {
+		config, err string
+	}{
+		{`{"host": "a.test", "docs-redirect": true}`, `unknown field "docs-redirect"`},
+		{`{"host": "a.test", "modules": [{"path": "a.test/m", "repo": "https://a.test/m", "sub_dir": "m"}]}`, `unknown field "sub_dir"`},
+		{`{"hosts": [{"host": "a.test", "branding": {"icon_url": "x"}}]}`, `unknown field "icon_url"`},
+		// host fields don't mix with hosts
+		{`{"hosts": [{"host": "a.test"}], "branch": "main"}`, `unknown field "branch"`},
+		{`{"hosts": []}`, "no hosts"},
+		{`[]`, "cannot unmarshal array"},
+	} {
+		fn := filepath.Join(t.TempDir(), "vanity.json")
+		err := ioutil.WriteFile(fn, []byte(tt.config), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Load(fn)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load(%s) = %v, want %s", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestRepoPrefix(t *testing.T) {
+	r := load(t, `{
+  "host": "vanity.test",
+  "repo_prefix": "https://github.com/example/",
+  "modules": [
+    { "path": "vanity.test/listed", "repo": "https://git.example.com/listed" }
+  ]
+}`)
+
+	tests := []struct {
+		p, path, goImport string
+		fallback          bool
+	}{
+		{"vanity.test/listed", "vanity.test/listed", "vanity.test/listed git https://git.example.com/listed", false},
+		{"vanity.test/listed/sub", "vanity.test/listed", "vanity.test/listed git https://git.example.com/listed", false},
+		{"vanity.test/other", "vanity.test/other", "vanity.test/other git https://github.com/example/other", true},
+		{"vanity.test/other/sub/pkg", "vanity.test/other", "vanity.test/other git https://github.com/example/other", true},
+	}
+	for _, tt := range tests {
+		m, ok := r.Lookup(tt.p)
+		if !ok {
+			t.Errorf("Lookup(%s): not found", tt.p)
+			continue
+		}
+		if m.Path != tt.path || m.GoImport() != tt.goImport || m.IsFallback() != tt.fallback {
+			t.Errorf("Lookup(%s) = %s %q fallback %v, want %s %q fallback %v",
+				tt.p, m.Path, m.GoImport(), m.IsFallback(), tt.path, tt.goImport, tt.fallback)
+		}
+	}
+	if m, ok := r.Lookup("vanity.test/other"); ok && m.GoSource() == "" {
+		t.Error("no go-source for a github fallback module")
+	}
+
+	for _, p := range []string{"vanity.test", "vanity.test/.hidden", "other.test/other"} {
+		if m, ok := r.Lookup(p); ok {
+			t.Errorf("Lookup(%s) = %s, want not found", p, m.Path)
+		}
+	}
+
+	// only listed modules without it
+	r = load(t, `{"host": "vanity.test"}`)
+	if m, ok := r.Lookup("vanity.test/other"); ok {
+		t.Errorf("Lookup without repo_prefix = %s, want not found", m.Path)
+	}
+}
+
+func TestDeployConfig(t *testing.T) {
+	r, err := Load(filepath.Join("..", "..", "deploy", "k8s", "vanity.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := r.Host("go.seankhliao.com")
+	if !ok {
+		t.Fatal("no go.seankhliao.com host")
+	}
+	if h.Redirect != "" {
+		t.Errorf("redirect %s hides the module index", h.Redirect)
+	}
+	for _, p := range []string{"go.seankhliao.com/vanity", "go.seankhliao.com/gchat"} {
+		if _, ok := h.Lookup(p); !ok {
+			t.Errorf("%s not served", p)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package serve
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"k8s.io/klog/v2"
+)
+
+// acmeRenewInterval is how often certificates are checked for renewal,
+// well within the renewal window of autocert
+const acmeRenewInterval = 12 * time.Hour
+
+// acmeCerts gets certificates for the service hosts from an ACME CA,
+// answering HTTP-01 challenges on a plain http listener
+// and TLS-ALPN-01 challenges on the main listener
+// (CAs only connect to port 443 for those).
+type acmeCerts struct {
+	m     *autocert.Manager
+	hosts func() []string
+}
+
+func newACMECerts(dir, email, directory string, hosts func() []string) *acmeCerts {
+	return &acmeCerts{
+		m: &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  autocert.DirCache(dir),
+			HostPolicy: func(ctx context.Context, host string) error {
+				for _, h := range hosts() {
+					if h == host {
+						return nil
+					}
+				}
+				return errors.New("unknown host " + host)
+			},
+			Email:  email,
+			Client: &acme.Client{DirectoryURL: directory},
+		},
+		hosts: hosts,
+	}
+}
+
+// config is a server config with certificates from the CA
+func (a *acmeCerts) config(minVersion uint16) *tls.Config {
+	conf := a.m.TLSConfig()
+	conf.MinVersion = minVersion
+	return conf
+}
+
+// httpHandler answers HTTP-01 challenges and redirects everything else to https
+func (a *acmeCerts) httpHandler() http.Handler {
+	return a.m.HTTPHandler(nil)
+}
+
+// run gets certificates for all the hosts up front,
+// and renews them when they're close to expiring, until ctx is done
+func (a *acmeCerts) run(ctx context.Context) {
+	t := time.NewTicker(acmeRenewInterval)
+	defer t.Stop()
+	for {
+		for _, h := range a.hosts() {
+			if ctx.Err() != nil {
+				return
+			}
+			// looks like a modern client, to get an ECDSA certificate
+			_, err := a.m.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:        h,
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedCurves:   []tls.CurveID{tls.CurveP256},
+				CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+			})
+			if err != nil {
+				klog.ErrorS(err, "get acme certificate", "host", h)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
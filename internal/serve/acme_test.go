@@ -0,0 +1,484 @@
+package serve
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// testCA is an ACME CA that validates challenges
+// by connecting to the listeners of the service under test
+type testCA struct {
+	t   *testing.T
+	url string
+	// challenges offered for authorizations
+	challenges []string
+	// tlsAddr and httpAddr are where challenges are checked
+	tlsAddr, httpAddr string
+
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+
+	mu sync.Mutex
+	// thumbprint of the account key
+	thumbprint string
+	orders     []*testOrder
+	// validated challenge types, in order
+	validated []string
+}
+
+type testOrder struct {
+	host   string
+	token  string
+	status string // of the authorization: pending, valid, invalid or deactivated
+	cert   []byte
+}
+
+func newTestCA(t *testing.T, challenges ...string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vanity test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{t: t, challenges: challenges, key: key, cert: cert}
+	srv := httptest.NewServer(ca)
+	t.Cleanup(srv.Close)
+	ca.url = srv.URL
+	return ca
+}
+
+func (ca *testCA) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	if location != "" {
+		w.Header().Set("Location", ca.url+location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *testCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/dir" {
+		ca.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   ca.url + "/nonce",
+			"newAccount": ca.url + "/account",
+			"newOrder":   ca.url + "/order",
+			"revokeCert": ca.url + "/revoke",
+		})
+		return
+	} else if r.URL.Path == "/nonce" {
+		ca.reply(w, http.StatusOK, "", nil)
+		return
+	}
+
+	// signatures aren't checked, only the payload is used
+	var jws struct {
+		Protected, Payload string
+	}
+	err := json.NewDecoder(r.Body).Decode(&jws)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	elems := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	var o *testOrder
+	var id string
+	if len(elems) >= 2 {
+		n, err := strconv.Atoi(elems[1])
+		if err != nil || n >= len(ca.orders) {
+			http.NotFound(w, r)
+			return
+		}
+		o, id = ca.orders[n], elems[1]
+	}
+
+	switch {
+	case elems[0] == "account":
+		err = ca.register(jws.Protected)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.reply(w, http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+
+	case elems[0] == "order" && o == nil:
+		var req struct {
+			Identifiers []struct{ Type, Value string }
+		}
+		err = json.Unmarshal(payload, &req)
+		if err != nil || len(req.Identifiers) != 1 {
+			http.Error(w, fmt.Sprintf("bad order %s: %v", payload, err), http.StatusBadRequest)
+			return
+		}
+		ca.orders = append(ca.orders, &testOrder{
+			host:   req.Identifiers[0].Value,
+			token:  fmt.Sprintf("token%d", len(ca.orders)),
+			status: "pending",
+		})
+		id = strconv.Itoa(len(ca.orders) - 1)
+		ca.reply(w, http.StatusCreated, "/order/"+id, ca.order(id, ca.orders[len(ca.orders)-1]))
+
+	case elems[0] == "order":
+		ca.reply(w, http.StatusOK, "/order/"+id, ca.order(id, o))
+
+	case elems[0] == "authz":
+		if len(payload) > 0 {
+			// deactivated
+			o.status = "deactivated"
+		}
+		ca.reply(w, http.StatusOK, "", ca.authz(id, o))
+
+	case elems[0] == "chal" && len(elems) == 3:
+		if o.status == "pending" {
+			err = ca.validate(elems[2], o)
+			if err != nil {
+				ca.t.Logf("%s for %s: %v", elems[2], o.host, err)
+				o.status = "invalid"
+			} else {
+				ca.validated = append(ca.validated, elems[2])
+				o.status = "valid"
+			}
+		}
+		ca.reply(w, http.StatusOK, "", ca.chal(id, elems[2], o))
+
+	case elems[0] == "finalize":
+		var req struct{ CSR string }
+		err = json.Unmarshal(payload, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if o.status != "valid" {
+			http.Error(w, "order not ready", http.StatusForbidden)
+			return
+		}
+		o.cert, err = ca.issue(req.CSR, o.host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.reply(w, http.StatusOK, "/order/"+id, ca.order(id, o))
+
+	case elems[0] == "cert" && o.cert != nil:
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: o.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// register records the thumbprint of the account key
+func (ca *testCA) register(protected string) error {
+	b, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return err
+	}
+	var h struct {
+		JWK struct{ Kty, Crv, X, Y string }
+	}
+	err = json.Unmarshal(b, &h)
+	if err != nil {
+		return err
+	} else if h.JWK.Kty != "EC" || h.JWK.Crv != "P-256" {
+		return fmt.Errorf("unsupported account key %s %s", h.JWK.Kty, h.JWK.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(h.JWK.X)
+	if err != nil {
+		return err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(h.JWK.Y)
+	if err != nil {
+		return err
+	}
+	ca.thumbprint, err = acme.JWKThumbprint(&ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	})
+	return err
+}
+
+func (ca *testCA) order(id string, o *testOrder) map[string]interface{} {
+	v := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.host}},
+		"authorizations": []string{ca.url + "/authz/" + id},
+		"finalize":       ca.url + "/finalize/" + id,
+	}
+	switch {
+	case o.cert != nil:
+		v["status"] = "valid"
+		v["certificate"] = ca.url + "/cert/" + id
+	case o.status == "valid":
+		v["status"] = "ready"
+	case o.status != "pending":
+		v["status"] = "invalid"
+	}
+	return v
+}
+
+func (ca *testCA) authz(id string, o *testOrder) map[string]interface{} {
+	var chals []map[string]string
+	for _, typ := range ca.challenges {
+		chals = append(chals, ca.chal(id, typ, o))
+	}
+	return map[string]interface{}{
+		"status":     o.status,
+		"identifier": map[string]string{"type": "dns", "value": o.host},
+		"challenges": chals,
+	}
+}
+
+func (ca *testCA) chal(id, typ string, o *testOrder) map[string]string {
+	return map[string]string{
+		"type":   typ,
+		"url":    ca.url + "/chal/" + id + "/" + typ,
+		"token":  o.token,
+		"status": o.status,
+	}
+}
+
+// validate checks a challenge response the way a CA would
+func (ca *testCA) validate(typ string, o *testOrder) error {
+	keyAuth := o.token + "." + ca.thumbprint
+	switch typ {
+	case "http-01":
+		req, err := http.NewRequest(http.MethodGet, "http://"+ca.httpAddr+"/.well-known/acme-challenge/"+o.token, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = o.host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		} else if res.StatusCode != http.StatusOK || strings.TrimSpace(string(b)) != keyAuth {
+			return fmt.Errorf("got %s %q, want %q", res.Status, b, keyAuth)
+		}
+		return nil
+
+	case "tls-alpn-01":
+		conn, err := tls.Dial("tcp", ca.tlsAddr, &tls.Config{
+			ServerName:         o.host,
+			NextProtos:         []string{"acme-tls/1"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != "acme-tls/1" {
+			return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+		}
+		// id-pe-acmeIdentifier
+		oid := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+		want := sha256.Sum256([]byte(keyAuth))
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			if !ext.Id.Equal(oid) {
+				continue
+			}
+			var got []byte
+			_, err = asn1.Unmarshal(ext.Value, &got)
+			if err != nil {
+				return err
+			} else if string(got) != string(want[:]) {
+				return errors.New("wrong key authorization")
+			}
+			return nil
+		}
+		return errors.New("no acme identifier")
+	}
+	return fmt.Errorf("unknown challenge %s", typ)
+}
+
+func (ca *testCA) issue(csr64, host string) ([]byte, error) {
+	der, err := base64.RawURLEncoding.DecodeString(csr64)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	} else if len(csr.DNSNames) != 1 || csr.DNSNames[0] != host {
+		return nil, fmt.Errorf("csr for %v, want %s", csr.DNSNames, host)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	var mu sync.Mutex
+	hosts := []string{"vanity.test"}
+	a := newACMECerts(t.TempDir(), "", "http://acme.invalid/dir", func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return hosts
+	})
+	ctx := context.Background()
+
+	if err := a.m.HostPolicy(ctx, "vanity.test"); err != nil {
+		t.Errorf("HostPolicy(vanity.test) = %v", err)
+	}
+	for _, h := range []string{"other.test", "sub.vanity.test", ""} {
+		if err := a.m.HostPolicy(ctx, h); err == nil {
+			t.Errorf("HostPolicy(%q) allowed", h)
+		}
+	}
+
+	// hosts are looked up on every check
+	mu.Lock()
+	hosts = append(hosts, "other.test")
+	mu.Unlock()
+	if err := a.m.HostPolicy(ctx, "other.test"); err != nil {
+		t.Errorf("HostPolicy(other.test) after adding it = %v", err)
+	}
+}
+
+func TestACME(t *testing.T) {
+	for _, typ := range []string{"tls-alpn-01", "http-01"} {
+		t.Run(typ, func(t *testing.T) {
+			ca := newTestCA(t, typ)
+			a := newACMECerts(t.TempDir(), "admin@vanity.test", ca.url+"/dir", func() []string {
+				return []string{"vanity.test"}
+			})
+
+			// the main listener, and the one for http challenges
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			})}
+			srv.TLSConfig = a.config(tls.VersionTLS12)
+			srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+			go srv.ServeTLS(ln, "", "")
+			defer srv.Close()
+			httpSrv := httptest.NewServer(a.httpHandler())
+			defer httpSrv.Close()
+			ca.tlsAddr, ca.httpAddr = ln.Addr().String(), strings.TrimPrefix(httpSrv.URL, "http://")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				a.run(ctx)
+			}()
+
+			// certificates are requested up front
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.cert)
+			var conn *tls.Conn
+			for deadline := time.Now().Add(10 * time.Second); ; {
+				conn, err = tls.Dial("tcp", ca.tlsAddr, &tls.Config{ServerName: "vanity.test", RootCAs: pool})
+				if err == nil || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("handshake with certificate from the CA: %v", err)
+			}
+			conn.Close()
+			ca.mu.Lock()
+			validated := strings.Join(ca.validated, " ")
+			ca.mu.Unlock()
+			if validated != typ {
+				t.Errorf("validated challenges = %q, want %s", validated, typ)
+			}
+
+			// no certificates for other hosts
+			_, err = tls.Dial("tcp", ca.tlsAddr, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true})
+			if err == nil {
+				t.Error("handshake for unknown host succeeded")
+			}
+
+			// everything else over http goes to https
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			req, err := http.NewRequest(http.MethodGet, httpSrv.URL+"/foo?go-get=1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "vanity.test"
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if loc := res.Header.Get("Location"); loc != "https://vanity.test/foo?go-get=1" {
+				t.Errorf("http redirect = %s %s, want https://vanity.test/foo?go-get=1", res.Status, loc)
+			}
+
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Error("run didn't return after cancel")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds a single readiness check
+const checkTimeout = 5 * time.Second
+
+// Health is the liveness and readiness of the process.
+// It's ready once the service is set up and serving,
+// until it starts draining on shutdown,
+// and as long as all the registered checks pass.
+type Health struct {
+	mu       sync.Mutex
+	ready    bool
+	draining bool
+	checks   []readyCheck
+}
+
+type readyCheck struct {
+	name string
+	f    func(ctx context.Context) error
+}
+
+// AddReadyCheck registers a check that has to pass for the service to be ready
+func (h *Health) AddReadyCheck(name string, f func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, readyCheck{name, f})
+}
+
+func (h *Health) setReady() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = true
+}
+
+func (h *Health) setDraining() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+}
+
+// serveLive always succeeds while the process can answer
+func (h *Health) serveLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *Health) serveReady(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	ready, draining := h.ready, h.draining
+	checks := append([]readyCheck(nil), h.checks...)
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case draining:
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	case !ready:
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+
+	var failed bool
+	msg := make([]string, 0, len(checks))
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		err := c.f(ctx)
+		cancel()
+		if err != nil {
+			failed = true
+			msg = append(msg, fmt.Sprintf("%s: %v", c.name, err))
+		} else {
+			msg = append(msg, c.name+": ok")
+		}
+	}
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, m := range msg {
+		fmt.Fprintln(w, m)
+	}
+	if !failed {
+		fmt.Fprintln(w, "ok")
+	}
+}
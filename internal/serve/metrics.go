@@ -0,0 +1,314 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are histogram buckets for request latencies in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics is a set of metrics exported in the Prometheus text format
+type Metrics struct {
+	mu       sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w io.Writer)
+}
+
+func (m *Metrics) register(f family) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.families = append(m.families, f)
+}
+
+// ServeHTTP writes all metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	families := append([]family(nil), m.families...)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	bw.Flush()
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counter
+}
+
+type counter struct {
+	values []string
+	v      float64
+}
+
+// Counter registers a counter with the given label names
+func (m *Metrics) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*counter),
+	}
+	m.register(c)
+	return c
+}
+
+// Inc adds 1 to the counter for the label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter for the label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s: %d label values for %d labels", c.name, len(values), len(c.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counter{values: append([]string(nil), values...)}
+		c.series[key] = s
+	}
+	s.v += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values, "", ""), formatFloat(s.v))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	values []string
+	// counts are per bucket, not cumulative,
+	// with the last one for +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram registers a histogram with the given upper bounds and label names
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	m.register(h)
+	return h
+}
+
+// Observe records v in the histogram for the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	if len(values) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s: %d label values for %d labels", h.name, len(values), len(h.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values, "", ""), s.count)
+	}
+}
+
+// runtimeStats are the Go runtime metrics, read on every scrape
+type runtimeStats struct {
+	start time.Time
+}
+
+func (rs runtimeStats) write(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauges := []struct {
+		name, help, typ string
+		v               float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge", float64(ms.Alloc)},
+		{"go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", "counter", float64(ms.TotalAlloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge", float64(ms.Sys)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", "gauge", float64(ms.HeapInuse)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", "gauge", float64(ms.HeapObjects)},
+		{"go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", "gauge", float64(ms.StackInuse)},
+		{"go_memstats_gc_total", "Number of completed GC cycles.", "counter", float64(ms.NumGC)},
+		{"go_memstats_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter", float64(ms.PauseTotalNs) / 1e9},
+		{"process_start_time_seconds", "Start time of the process since unix epoch in seconds.", "gauge", float64(rs.start.UnixNano()) / 1e9},
+	}
+	for _, g := range gauges {
+		writeHeader(w, g.name, g.help, g.typ)
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.v))
+	}
+	writeHeader(w, "go_info", "Information about the Go environment.", "gauge")
+	fmt.Fprintf(w, "go_info%s 1\n", formatLabels([]string{"version"}, []string{runtime.Version()}, "", ""))
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// formatLabels formats label pairs, with an optional extra pair at the end
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	esc := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, n, esc.Replace(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extraName, esc.Replace(extraValue))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type routeKey struct{}
+
+// SetRoute names the route handling a request in the request metrics,
+// instead of the matching ServeMux pattern
+func SetRoute(r *http.Request, route string) {
+	if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*p = route
+	}
+}
+
+// instrument records request counts and latencies
+func instrument(h http.Handler, mux *http.ServeMux, m *Metrics) http.Handler {
+	requests := m.Counter("http_requests_total", "Requests served, by route and status code.", "route", "code")
+	latency := m.Histogram("http_request_duration_seconds", "Request latencies, by route and status code.", DefBuckets, "route", "code")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		var route string
+		r = r.WithContext(context.WithValue(r.Context(), routeKey{}, &route))
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+
+		if route == "" {
+			_, route = mux.Handler(r)
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		code := strconv.Itoa(sw.status)
+		requests.Inc(route, code)
+		latency.Observe(time.Since(t).Seconds(), route, code)
+	})
+}
+
+// statusWriter records the response status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -2,14 +2,16 @@ package serve
 
 import (
 	"context"
-	"errors"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"golang.org/x/crypto/acme/autocert"
 	"k8s.io/klog/v2"
 )
 
@@ -22,68 +24,180 @@ type Service interface {
 type Components struct {
 	Mux    *http.ServeMux
 	Server *http.Server
+
+	// Admin is served on the admin address, apart from the main traffic
+	Admin   *http.ServeMux
+	Metrics *Metrics
+	Health  *Health
+
+	// Hosts are the domains served, set during Setup,
+	// certificates are requested for them in ACME mode
+	Hosts []string
+}
+
+// options are the flags of Run
+type options struct {
+	addr, adminAddr                                 string
+	tlsCert, tlsKey, tlsClientCA, tlsMin            string
+	acmeDir, acmeEmail, acmeDirectory, acmeHTTPAddr string
+	drain, shutdownTimeout                          time.Duration
 }
 
 func Run(svc Service) int {
-	var addr string
-	flag.StringVar(&addr, "addr", os.Getenv("PORT"), "address")
+	var o options
+	flag.StringVar(&o.addr, "addr", os.Getenv("PORT"), "address")
+	flag.StringVar(&o.adminAddr, "admin-addr", ":8000", "address for metrics and health checks, empty to disable")
+	flag.DurationVar(&o.drain, "drain", 5*time.Second, "time to report not ready before shutting down")
+	flag.DurationVar(&o.shutdownTimeout, "shutdown-timeout", 5*time.Second, "time for requests in flight to finish when shutting down")
+	flag.StringVar(&o.tlsCert, "tls-cert", "", "tls certificate file, serves https with -tls-key, reloaded on change")
+	flag.StringVar(&o.tlsKey, "tls-key", "", "tls private key file")
+	flag.StringVar(&o.tlsClientCA, "tls-client-ca", "", "ca file to verify required client certificates against")
+	flag.StringVar(&o.tlsMin, "tls-min-version", "1.2", "minimum tls version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&o.acmeDir, "acme-dir", "", "directory to store acme account and certificates in, serves https with certificates for all hosts, tls-alpn challenges need -addr to be :443")
+	flag.StringVar(&o.acmeEmail, "acme-email", "", "contact email for the acme account")
+	flag.StringVar(&o.acmeDirectory, "acme-directory", autocert.DefaultACMEDirectory, "acme CA directory url")
+	flag.StringVar(&o.acmeHTTPAddr, "acme-http-addr", ":80", "address for acme http challenges and redirects to https")
 	klog.InitFlags(nil)
 	svc.InitFlags(nil)
 	flag.Parse()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	return run(svc, o, sigc)
+}
+
+// run serves svc until a signal on sigc or a server fails,
+// returning the exit code
+func run(svc Service, o options, sigc <-chan os.Signal) int {
+	addr, adminAddr := o.addr, o.adminAddr
 	if addr == "" {
 		addr = ":8080"
 	} else if addr[0] != ':' {
 		addr = ":" + addr
 	}
 
+	if adminAddr != "" && adminAddr[0] != ':' && !strings.Contains(adminAddr, ":") {
+		adminAddr = ":" + adminAddr
+	}
+	minVersion, ok := tlsVersions[o.tlsMin]
+	if !ok {
+		klog.ErrorS(nil, "unknown tls version", "tls-min-version", o.tlsMin)
+		return exitConfig
+	}
+	if (o.tlsCert == "") != (o.tlsKey == "") || (o.tlsClientCA != "" && o.tlsCert == "") {
+		klog.ErrorS(nil, "tls needs both -tls-cert and -tls-key")
+		return exitConfig
+	}
+	if o.acmeDir != "" && (o.tlsCert != "" || o.tlsClientCA != "") {
+		klog.ErrorS(nil, "-acme-dir can't be used with -tls-cert or -tls-client-ca")
+		return exitConfig
+	}
+
 	mux := http.NewServeMux()
+	metrics := &Metrics{}
+	metrics.register(runtimeStats{start: time.Now()})
 	c := &Components{
 		Mux: mux,
 		Server: &http.Server{
 			Addr:              addr,
-			Handler:           corsAllowAll(mux),
+			Handler:           instrument(corsAllowAll(mux), mux, metrics),
 			ReadHeaderTimeout: 10 * time.Second,
 			MaxHeaderBytes:    1 << 20,
 			// ErrorLog
 		},
+		Admin:   http.NewServeMux(),
+		Metrics: metrics,
+		Health:  &Health{},
+	}
+	c.Admin.Handle("/metrics", metrics)
+	c.Admin.HandleFunc("/healthz", c.Health.serveLive)
+	c.Admin.HandleFunc("/readyz", c.Health.serveReady)
+	admin := &http.Server{
+		Addr:              adminAddr,
+		Handler:           c.Admin,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    1 << 20,
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, sup := newSupervisor(context.Background())
+	if o.tlsCert != "" {
+		certs, err := newCertReloader(o.tlsCert, o.tlsKey, o.tlsClientCA)
+		if err != nil {
+			sup.stop(exitConfig, "load tls files", err)
+			return sup.exit()
+		}
+		c.Server.TLSConfig = certs.config(minVersion)
+		go certs.run(ctx)
+	}
+	var acmeCerts *acmeCerts
+	var acmeHTTP *http.Server
+	if o.acmeDir != "" {
+		acmeCerts = newACMECerts(o.acmeDir, o.acmeEmail, o.acmeDirectory, func() []string { return c.Hosts })
+		c.Server.TLSConfig = acmeCerts.config(minVersion)
+		acmeHTTP = &http.Server{
+			Addr:              o.acmeHTTPAddr,
+			Handler:           acmeCerts.httpHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+		}
+	}
 	go func() {
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-		<-sigc
-		cancel()
+		var sig os.Signal
+		select {
+		case sig = <-sigc:
+		case <-ctx.Done():
+			return
+		}
+		// keep serving while load balancers notice we're going away,
+		// a second signal skips the wait
+		klog.InfoS("draining", "signal", sig, "duration", o.drain)
+		c.Health.setDraining()
+		t := time.NewTimer(o.drain)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-sigc:
+		case <-ctx.Done():
+		}
+		sup.stop(exitOK, "signal "+sig.String(), nil)
 	}()
 
+	// servers that have started, to shut down
+	servers := make(map[string]*http.Server)
+
+	// health checks are up while the service is set up
+	if admin.Addr != "" {
+		servers["admin server"] = admin
+		go sup.serve("admin server", admin, nil)
+	}
+
 	err := svc.Setup(ctx, c)
 	if err != nil {
-		klog.ErrorS(err, "service setup")
-		return 2
+		sup.stop(exitConfig, "service setup", err)
 	}
 
-	errc := make(chan error)
-	go func() {
-		defer cancel()
-		klog.InfoS("starting server", "addr", c.Server.Addr)
-		err := c.Server.ListenAndServe()
-		switch {
-		case errors.Is(err, http.ErrServerClosed):
-			close(errc)
-		case err != nil:
-			errc <- err
-		default:
-			close(errc)
+	// only ready once we're accepting connections
+	if ctx.Err() == nil {
+		ln, err := net.Listen("tcp", c.Server.Addr)
+		if err != nil {
+			sup.stop(exitFailed, "listen", err)
+		} else {
+			servers["server"] = c.Server
+			go sup.serve("server", c.Server, ln)
+			if acmeCerts != nil {
+				servers["acme http server"] = acmeHTTP
+				go sup.serve("acme http server", acmeHTTP, nil)
+				go acmeCerts.run(ctx)
+			}
+			c.Health.setReady()
 		}
-	}()
+	}
 
 	<-ctx.Done()
-	err = c.Server.Shutdown(context.Background())
-	if err != nil {
-		klog.ErrorS(err, "server shutdown")
-		return 1
-	}
-	return 0
+	sctx, cancel := context.WithTimeout(context.Background(), o.shutdownTimeout)
+	defer cancel()
+	sup.shutdown(sctx, servers)
+	return sup.exit()
 }
 
 func corsAllowAll(h http.Handler) http.Handler {
@@ -0,0 +1,185 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testService serves handler, or fails setup with err
+type testService struct {
+	handler http.Handler
+	err     error
+}
+
+func (s *testService) InitFlags(fs *flag.FlagSet) {}
+
+func (s *testService) Setup(ctx context.Context, c *Components) error {
+	if s.err != nil {
+		return s.err
+	}
+	c.Mux.Handle("/", s.handler)
+	return nil
+}
+
+// freePort is a port nothing was listening on just now
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// start runs svc in the background, returning its exit code when done
+func start(t *testing.T, svc Service, o options, sigc <-chan os.Signal) <-chan int {
+	t.Helper()
+	done := make(chan int, 1)
+	go func() {
+		done <- run(svc, o, sigc)
+	}()
+	return done
+}
+
+func waitExit(t *testing.T, done <-chan int, timeout time.Duration) int {
+	t.Helper()
+	select {
+	case code := <-done:
+		return code
+	case <-time.After(timeout):
+		t.Fatalf("didn't exit within %v", timeout)
+		return -1
+	}
+}
+
+// waitServing waits for the server on port to answer
+func waitServing(t *testing.T, port string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		res, err := http.Get("http://127.0.0.1:" + port + "/")
+		if err == nil {
+			res.Body.Close()
+			return
+		}
+	}
+	t.Fatal("server didn't start")
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+func TestRunConfig(t *testing.T) {
+	for _, o := range []options{
+		{tlsMin: "9.9"},
+		{tlsMin: "1.2", tlsCert: "cert.pem"},
+		{tlsMin: "1.2", tlsClientCA: "ca.pem"},
+		{tlsMin: "1.2", tlsCert: "cert.pem", tlsKey: "key.pem", acmeDir: "acme"},
+		{tlsMin: "1.2", tlsCert: "missing.pem", tlsKey: "missing.pem"},
+	} {
+		o.addr = freePort(t)
+		done := start(t, &testService{handler: okHandler}, o, nil)
+		if code := waitExit(t, done, 5*time.Second); code != exitConfig {
+			t.Errorf("run with %+v = %d, want %d", o, code, exitConfig)
+		}
+	}
+
+	o := options{addr: freePort(t), tlsMin: "1.2"}
+	done := start(t, &testService{err: errors.New("broken")}, o, nil)
+	if code := waitExit(t, done, 5*time.Second); code != exitConfig {
+		t.Errorf("run with failing setup = %d, want %d", code, exitConfig)
+	}
+}
+
+func TestRunListenFails(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	inUse := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	for name, o := range map[string]options{
+		"server": {addr: inUse, tlsMin: "1.2"},
+		"admin":  {addr: freePort(t), adminAddr: inUse, tlsMin: "1.2"},
+	} {
+		done := start(t, &testService{handler: okHandler}, o, nil)
+		if code := waitExit(t, done, 5*time.Second); code != exitFailed {
+			t.Errorf("%s port in use: exit %d, want %d", name, code, exitFailed)
+		}
+	}
+}
+
+func TestRunSignal(t *testing.T) {
+	o := options{addr: freePort(t), tlsMin: "1.2", drain: 200 * time.Millisecond, shutdownTimeout: time.Second}
+	sigc := make(chan os.Signal, 2)
+	done := start(t, &testService{handler: okHandler}, o, sigc)
+	waitServing(t, o.addr)
+
+	t0 := time.Now()
+	sigc <- syscall.SIGTERM
+	// still serving while draining
+	time.Sleep(50 * time.Millisecond)
+	res, err := http.Get("http://127.0.0.1:" + o.addr + "/")
+	if err != nil {
+		t.Errorf("request while draining: %v", err)
+	} else {
+		res.Body.Close()
+	}
+	if code := waitExit(t, done, 5*time.Second); code != exitOK {
+		t.Errorf("exit after signal = %d, want %d", code, exitOK)
+	}
+	if d := time.Since(t0); d < o.drain {
+		t.Errorf("exited after %v, before the %v drain", d, o.drain)
+	}
+
+	// a second signal skips the drain
+	o = options{addr: freePort(t), tlsMin: "1.2", drain: time.Hour, shutdownTimeout: time.Second}
+	done = start(t, &testService{handler: okHandler}, o, sigc)
+	waitServing(t, o.addr)
+	sigc <- syscall.SIGTERM
+	sigc <- syscall.SIGINT
+	if code := waitExit(t, done, 5*time.Second); code != exitOK {
+		t.Errorf("exit after second signal = %d, want %d", code, exitOK)
+	}
+}
+
+func TestRunShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+	stuck := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stuck" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("ok"))
+	})
+
+	o := options{addr: freePort(t), tlsMin: "1.2", shutdownTimeout: 100 * time.Millisecond}
+	sigc := make(chan os.Signal, 1)
+	done := start(t, &testService{handler: stuck}, o, sigc)
+	waitServing(t, o.addr)
+	go func() {
+		res, err := http.Get("http://127.0.0.1:" + o.addr + "/stuck")
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	sigc <- syscall.SIGTERM
+	// the request in flight doesn't hold up the exit
+	if code := waitExit(t, done, 5*time.Second); code != exitFailed {
+		t.Errorf("exit with a request stuck past the shutdown timeout = %d, want %d", code, exitFailed)
+	}
+}
@@ -0,0 +1,113 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// exit codes
+const (
+	exitOK     = 0 // stopped by a signal and shut down cleanly
+	exitFailed = 1 // a server failed or didn't shut down in time
+	exitConfig = 2 // bad flags or the service couldn't be set up
+)
+
+// supervisor collects why the process is stopping.
+// The first reason wins and cancels the shared context,
+// later ones are only logged.
+type supervisor struct {
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	done  bool
+	code  int
+	cause string
+	err   error
+}
+
+func newSupervisor(ctx context.Context) (context.Context, *supervisor) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &supervisor{cancel: cancel}
+}
+
+// stop records a reason to stop and cancels the context
+func (s *supervisor) stop(code int, cause string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		if err != nil {
+			klog.ErrorS(err, cause, "stopping", s.cause)
+		}
+		return
+	}
+	s.done, s.code, s.cause, s.err = true, code, cause, err
+	s.cancel()
+}
+
+// fail sets a non zero exit code for problems during shutdown,
+// keeping the original cause
+func (s *supervisor) fail(cause string, err error) {
+	klog.ErrorS(err, cause)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.code == exitOK {
+		s.code = exitFailed
+	}
+}
+
+// exit logs why the process stopped and returns its exit code
+func (s *supervisor) exit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.code == exitOK {
+		klog.InfoS("exiting", "cause", s.cause, "code", s.code)
+	} else {
+		klog.ErrorS(s.err, "exiting", "cause", s.cause, "code", s.code)
+	}
+	return s.code
+}
+
+// serve runs srv on ln, or listens on its address if ln is nil,
+// stopping everything if it fails for any reason other than a shutdown
+func (s *supervisor) serve(name string, srv *http.Server, ln net.Listener) {
+	klog.InfoS("starting "+name, "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+	var err error
+	switch {
+	case ln == nil:
+		err = srv.ListenAndServe()
+	case srv.TLSConfig != nil:
+		err = srv.ServeTLS(ln, "", "")
+	default:
+		err = srv.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	if err == nil {
+		err = errors.New("stopped serving")
+	}
+	s.stop(exitFailed, name, err)
+}
+
+// shutdown gracefully stops all the servers at once,
+// closing the ones that don't finish before ctx is done
+func (s *supervisor) shutdown(ctx context.Context, servers map[string]*http.Server) {
+	var wg sync.WaitGroup
+	for name, srv := range servers {
+		wg.Add(1)
+		go func(name string, srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				s.fail(name+" shutdown", err)
+				srv.Close()
+			}
+		}(name, srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// reloadInterval is how often certificate files are checked for changes
+const reloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves a certificate and client CAs from files,
+// picking up changes such as renewals without a restart
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime map[string]time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTime:  make(map[string]time.Time),
+	}
+	_, err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// run reloads the files when they change, until ctx is done
+func (cr *certReloader) run(ctx context.Context) {
+	t := time.NewTicker(reloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := cr.reload()
+		if err != nil {
+			klog.ErrorS(err, "reload tls files, keeping the previous ones")
+		} else if changed {
+			klog.InfoS("reloaded tls files", "cert", cr.certFile, "client_ca", cr.caFile)
+		}
+	}
+}
+
+// reload loads the files if any of their modification times changed.
+// Mounted secrets are replaced through symlinks, which stat follows.
+func (cr *certReloader) reload() (bool, error) {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.caFile != "" {
+		files = append(files, cr.caFile)
+	}
+	modTime := make(map[string]time.Time, len(files))
+	changed := false
+	for _, fn := range files {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return false, err
+		}
+		modTime[fn] = fi.ModTime()
+		if !fi.ModTime().Equal(cr.modTime[fn]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("load key pair: %w", err)
+	}
+	var pool *x509.CertPool
+	if cr.caFile != "" {
+		b, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return false, fmt.Errorf("read client ca: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return false, errors.New("no certificates in client ca " + cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert, cr.pool, cr.modTime = &cert, pool, modTime
+	return true, nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// config is a server config using the current files,
+// requiring client certificates if there are client CAs
+func (cr *certReloader) config(minVersion uint16) *tls.Config {
+	conf := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: cr.getCertificate,
+		// set here as configs for clients are cloned from this one,
+		// not from the one http.Server adds them to
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if cr.caFile == "" {
+		return conf
+	}
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.mu.RLock()
+		defer cr.mu.RUnlock()
+		c := conf.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = cr.pool
+		return c, nil
+	}
+	return conf
+}
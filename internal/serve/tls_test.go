@@ -0,0 +1,252 @@
+package serve
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by parent, or self signed CA if nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{"vanity.test"}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// files writes certificate files with distinct modification times
+type files struct {
+	t   *testing.T
+	dir string
+	n   int
+}
+
+func (f *files) write(name string, b []byte) string {
+	f.t.Helper()
+	fn := filepath.Join(f.dir, name)
+	err := ioutil.WriteFile(fn, b, 0600)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	// writes in quick succession can share a modification time
+	f.n++
+	mt := time.Now().Add(time.Duration(f.n) * time.Second)
+	err = os.Chtimes(fn, mt, mt)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return fn
+}
+
+// serveTLS answers every connection with "ok" after the handshake
+func serveTLS(t *testing.T, conf *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dial connects to addr and returns the server certificate name,
+// or an error if the connection was refused
+func dial(addr string, conf *tls.Config) (string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, conf)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_, err = ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestCertReload(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	one, two, three := newTestCert(t, "one", ca), newTestCert(t, "two", ca), newTestCert(t, "three", ca)
+	f := &files{t: t, dir: t.TempDir()}
+	certFile, keyFile := f.write("cert.pem", one.certPEM()), f.write("key.pem", one.keyPEM(t))
+
+	cr, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, cr.config(tls.VersionTLS12))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &tls.Config{ServerName: "vanity.test", RootCAs: pool}
+	check := func(want string) {
+		t.Helper()
+		got, err := dial(addr, client)
+		if err != nil || got != want {
+			t.Errorf("serving %q, %v, want %q", got, err, want)
+		}
+	}
+	reload := func(wantChanged, wantErr bool) {
+		t.Helper()
+		changed, err := cr.reload()
+		if changed != wantChanged || (err != nil) != wantErr {
+			t.Errorf("reload = %v, %v, want changed %v, error %v", changed, err, wantChanged, wantErr)
+		}
+	}
+	check("one")
+	reload(false, false)
+
+	// rotated
+	f.write("cert.pem", two.certPEM())
+	f.write("key.pem", two.keyPEM(t))
+	reload(true, false)
+	check("two")
+
+	// half way through a rotation: the old certificate stays
+	// until the next check finds a matching pair
+	f.write("cert.pem", three.certPEM())
+	reload(false, true)
+	check("two")
+	reload(false, true)
+	check("two")
+	f.write("key.pem", three.keyPEM(t))
+	reload(true, false)
+	check("three")
+
+	// files gone
+	os.Remove(keyFile)
+	reload(false, true)
+	check("three")
+}
+
+func TestClientCAReload(t *testing.T) {
+	caA, caB, serverCA := newTestCert(t, "a", nil), newTestCert(t, "b", nil), newTestCert(t, "server ca", nil)
+	server := newTestCert(t, "server", serverCA)
+	f := &files{t: t, dir: t.TempDir()}
+	certFile, keyFile := f.write("cert.pem", server.certPEM()), f.write("key.pem", server.keyPEM(t))
+	caFile := f.write("ca.pem", caA.certPEM())
+
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, cr.config(tls.VersionTLS12))
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCA.cert)
+	clientConf := func(c *testCert) *tls.Config {
+		conf := &tls.Config{ServerName: "vanity.test", RootCAs: pool}
+		if c != nil {
+			conf.Certificates = []tls.Certificate{c.tlsCert(t)}
+		}
+		return conf
+	}
+	clientA, clientB := newTestCert(t, "client a", caA), newTestCert(t, "client b", caB)
+	check := func(c *testCert, want bool) {
+		t.Helper()
+		_, err := dial(addr, clientConf(c))
+		if (err == nil) != want {
+			name := "no certificate"
+			if c != nil {
+				name = c.cert.Subject.CommonName
+			}
+			t.Errorf("connect with %s: %v, want ok %v", name, err, want)
+		}
+	}
+	check(clientA, true)
+	check(clientB, false)
+	check(nil, false)
+
+	f.write("ca.pem", caB.certPEM())
+	changed, err := cr.reload()
+	if !changed || err != nil {
+		t.Fatalf("reload = %v, %v", changed, err)
+	}
+	check(clientA, false)
+	check(clientB, true)
+
+	// not a certificate, the previous CAs stay
+	f.write("ca.pem", []byte("garbage"))
+	changed, err = cr.reload()
+	if changed || err == nil {
+		t.Errorf("reload with bad client ca = %v, %v, want error", changed, err)
+	}
+	check(clientB, true)
+}
@@ -0,0 +1,339 @@
+// Package sumdb is a checksum database for our own modules,
+// an append-only transparent log of go.sum lines stored on disk.
+package sumdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// GoSumFunc produces the go.sum lines for a module version,
+// ok is false if the version doesn't exist
+type GoSumFunc func(ctx context.Context, m module.Version) (lines []byte, ok bool, err error)
+
+// DB is a checksum database.
+//
+// Records are appended to dir/records, each prefixed with its length,
+// and the tree hashes to dir/hashes, so the log survives restarts.
+type DB struct {
+	signer note.Signer
+	gosum  GoSumFunc
+
+	mu      sync.Mutex
+	records *os.File
+	size    int64 // of records
+	hashes  *os.File
+	// failed is set when a failed append couldn't be undone,
+	// appending more would fork the log
+	failed error
+	texts  [][]byte
+	stored []tlog.Hash
+	index  map[module.Version]int64
+	signed []byte // signed tree head for len(texts)
+}
+
+// Open opens or creates a checksum database in dir,
+// signing with the note signer key in keyFile.
+func Open(dir, keyFile string, gosum GoSumFunc) (*DB, error) {
+	skey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	signer, err := note.NewSigner(strings.TrimSpace(string(skey)))
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		signer: signer,
+		gosum:  gosum,
+		index:  make(map[module.Version]int64),
+	}
+	db.records, err = os.OpenFile(filepath.Join(dir, "records"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.hashes, err = os.OpenFile(filepath.Join(dir, "hashes"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		db.records.Close()
+		return nil, err
+	}
+	err = db.load()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("load %s: %w", dir, err)
+	}
+	return db, nil
+}
+
+// load reads the log from disk,
+// dropping a partially written record
+// and recomputing any hashes lost to an interrupted append
+func (db *DB) load() error {
+	br := bufio.NewReader(db.records)
+	var off int64
+	for {
+		var n uint32
+		err := binary.Read(br, binary.BigEndian, &n)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("read record %d: %w", len(db.texts), err)
+		}
+		text := make([]byte, n)
+		if err == nil {
+			_, err = io.ReadFull(br, text)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			err = db.records.Truncate(off)
+			if err != nil {
+				return err
+			}
+			break
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", len(db.texts), err)
+		}
+		m, err := parseRecord(text)
+		if err != nil {
+			return fmt.Errorf("parse record %d: %w", len(db.texts), err)
+		}
+		db.index[m] = int64(len(db.texts))
+		db.texts = append(db.texts, text)
+		off += 4 + int64(n)
+	}
+	db.size = off
+
+	b, err := ioutil.ReadAll(db.hashes)
+	if err != nil {
+		return err
+	}
+	// keep only the hashes of whole records
+	var n int64
+	for n < int64(len(db.texts)) && tlog.StoredHashCount(n+1)*tlog.HashSize <= int64(len(b)) {
+		n++
+	}
+	keep := tlog.StoredHashCount(n)
+	if keep*tlog.HashSize != int64(len(b)) {
+		err = db.hashes.Truncate(keep * tlog.HashSize)
+		if err != nil {
+			return err
+		}
+	}
+	for i := int64(0); i < keep; i++ {
+		var h tlog.Hash
+		copy(h[:], b[i*tlog.HashSize:])
+		db.stored = append(db.stored, h)
+	}
+	for ; n < int64(len(db.texts)); n++ {
+		err = db.storeHashes(n, db.texts[n])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRecord finds the module version a record is for
+func parseRecord(text []byte) (module.Version, error) {
+	f := strings.Fields(string(text))
+	if len(f) < 3 {
+		return module.Version{}, fmt.Errorf("malformed record %q", text)
+	}
+	return module.Version{Path: f[0], Version: f[1]}, nil
+}
+
+// storeHashes appends the tree hashes for record n
+func (db *DB) storeHashes(n int64, text []byte) error {
+	hs, err := tlog.StoredHashes(n, text, db)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, h := range hs {
+		buf.Write(h[:])
+	}
+	_, err = db.hashes.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = db.hashes.Sync()
+	if err != nil {
+		return err
+	}
+	db.stored = append(db.stored, hs...)
+	return nil
+}
+
+// Close closes the underlying files
+func (db *DB) Close() error {
+	err1 := db.records.Close()
+	err2 := db.hashes.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// ReadHashes implements tlog.HashReader over the stored hashes,
+// callers must hold mu.
+func (db *DB) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	hs := make([]tlog.Hash, 0, len(indexes))
+	for _, i := range indexes {
+		if i < 0 || i >= int64(len(db.stored)) {
+			return nil, &os.PathError{Op: "read hash", Path: strconv.FormatInt(i, 10), Err: os.ErrNotExist}
+		}
+		hs = append(hs, db.stored[i])
+	}
+	return hs, nil
+}
+
+// Add records the go.sum lines for a module version if it isn't already,
+// returning its record id.
+// It returns an error satisfying os.IsNotExist if the version doesn't exist,
+// as the sumdb server expects.
+func (db *DB) Add(ctx context.Context, m module.Version) (int64, error) {
+	db.mu.Lock()
+	id, ok := db.index[m]
+	db.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	text, ok, err := db.gosum(ctx, m)
+	if err != nil {
+		return 0, fmt.Errorf("go.sum for %s: %w", m, err)
+	} else if !ok {
+		return 0, &os.PathError{Op: "lookup", Path: m.String(), Err: os.ErrNotExist}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if id, ok := db.index[m]; ok {
+		// added while we were hashing
+		return id, nil
+	}
+	if db.failed != nil {
+		return 0, db.failed
+	}
+	id = int64(len(db.texts))
+	b := make([]byte, 4+len(text))
+	binary.BigEndian.PutUint32(b, uint32(len(text)))
+	copy(b[4:], text)
+	_, err = db.records.Write(b)
+	if err == nil {
+		err = db.records.Sync()
+	}
+	if err == nil {
+		err = db.storeHashes(id, text)
+	}
+	if err != nil {
+		return 0, db.undo(err)
+	}
+	db.size += int64(len(b))
+	db.texts = append(db.texts, text)
+	db.index[m] = id
+	db.signed = nil
+	return id, nil
+}
+
+// undo removes what a failed append wrote,
+// so the next record doesn't land after it on disk while taking its id in memory.
+// If that fails too, no more records are accepted.
+func (db *DB) undo(err error) error {
+	uerr := db.records.Truncate(db.size)
+	if uerr == nil {
+		uerr = db.hashes.Truncate(int64(len(db.stored)) * tlog.HashSize)
+	}
+	if uerr == nil {
+		uerr = db.records.Sync()
+	}
+	if uerr == nil {
+		uerr = db.hashes.Sync()
+	}
+	if uerr != nil {
+		db.failed = fmt.Errorf("log closed for appends after failing to undo an append: %v", uerr)
+	}
+	return err
+}
+
+// Name is the name of the database, from the signing key
+func (db *DB) Name() string {
+	return db.signer.Name()
+}
+
+// Handler serves the checksum database protocol at the root,
+// along with supported for access through a proxy
+func (db *DB) Handler() http.Handler {
+	srv := sumdb.NewServer(ops{db})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/supported" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	})
+}
+
+// ops implements sumdb.ServerOps
+type ops struct {
+	db *DB
+}
+
+func (o ops) Signed(ctx context.Context) ([]byte, error) {
+	o.db.mu.Lock()
+	defer o.db.mu.Unlock()
+	if o.db.signed != nil {
+		return o.db.signed, nil
+	}
+	n := int64(len(o.db.texts))
+	h, err := tlog.TreeHash(n, o.db)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := note.Sign(&note.Note{Text: string(tlog.FormatTree(tlog.Tree{N: n, Hash: h}))}, o.db.signer)
+	if err != nil {
+		return nil, err
+	}
+	o.db.signed = signed
+	return signed, nil
+}
+
+func (o ops) ReadRecords(ctx context.Context, id, n int64) ([][]byte, error) {
+	o.db.mu.Lock()
+	defer o.db.mu.Unlock()
+	if id < 0 || n < 0 || id+n > int64(len(o.db.texts)) {
+		return nil, &os.PathError{Op: "read records", Path: fmt.Sprintf("%d+%d", id, n), Err: os.ErrNotExist}
+	}
+	return o.db.texts[id : id+n], nil
+}
+
+func (o ops) Lookup(ctx context.Context, m module.Version) (int64, error) {
+	return o.db.Add(ctx, m)
+}
+
+func (o ops) ReadTileData(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	o.db.mu.Lock()
+	defer o.db.mu.Unlock()
+	return tlog.ReadTileData(t, o.db)
+}
@@ -0,0 +1,300 @@
+package sumdb
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// goSum is a GoSumFunc with made up hashes for any v1 version
+func goSum(ctx context.Context, m module.Version) ([]byte, bool, error) {
+	if !strings.HasPrefix(m.Version, "v1.") {
+		return nil, false, nil
+	}
+	return []byte(fmt.Sprintf("%s %s h1:%s=\n%s %s/go.mod h1:%s=\n",
+		m.Path, m.Version, strings.Repeat("A", 43), m.Path, m.Version, strings.Repeat("B", 43))), true, nil
+}
+
+// newKey writes a signer key and returns its file and verifier key
+func newKey(t *testing.T) (string, string) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, "vanity.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "key")
+	err = ioutil.WriteFile(fn, []byte(skey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn, vkey
+}
+
+func open(t *testing.T, dir, keyFile string) *DB {
+	t.Helper()
+	db, err := Open(dir, keyFile, goSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func add(t *testing.T, db *DB, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := db.Add(context.Background(), module.Version{Path: "vanity.test/m", Version: fmt.Sprintf("v1.0.%d", len(db.texts))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// client verifies the database the same way the go command does
+type client struct {
+	*sumdb.Client
+	ops *clientOps
+}
+
+func newClient(t *testing.T, vkey string) *client {
+	ops := &clientOps{t: t, vkey: vkey, cache: make(map[string][]byte)}
+	return &client{sumdb.NewClient(ops), ops}
+}
+
+// lookup verifies the lines for m against the database at url
+func (c *client) lookup(url string, m module.Version) ([]string, error) {
+	c.ops.mu.Lock()
+	c.ops.url = url
+	c.ops.mu.Unlock()
+	return c.Lookup(m.Path, m.Version)
+}
+
+type clientOps struct {
+	t    *testing.T
+	vkey string
+
+	mu     sync.Mutex
+	url    string
+	latest []byte
+	cache  map[string][]byte
+}
+
+func (o *clientOps) ReadRemote(path string) ([]byte, error) {
+	o.mu.Lock()
+	url := o.url
+	o.mu.Unlock()
+	res, err := http.Get(url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s: %s", path, res.Status, b)
+	}
+	return b, nil
+}
+
+func (o *clientOps) ReadConfig(file string) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch file {
+	case "key":
+		return []byte(o.vkey), nil
+	case "vanity.test/latest":
+		return o.latest, nil
+	}
+	return nil, fmt.Errorf("unknown config %s", file)
+}
+
+func (o *clientOps) WriteConfig(file string, old, new []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if string(old) != string(o.latest) {
+		return sumdb.ErrWriteConflict
+	}
+	o.latest = new
+	return nil
+}
+
+func (o *clientOps) ReadCache(file string) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b, ok := o.cache[file]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return b, nil
+}
+
+func (o *clientOps) WriteCache(file string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cache[file] = data
+}
+
+func (o *clientOps) Log(msg string) {}
+
+func (o *clientOps) SecurityError(msg string) {
+	o.t.Errorf("security error: %s", msg)
+}
+
+func serve(t *testing.T, db *DB) string {
+	t.Helper()
+	srv := httptest.NewServer(db.Handler())
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestClientVerify(t *testing.T) {
+	keyFile, vkey := newKey(t)
+	dir := t.TempDir()
+	db := open(t, dir, keyFile)
+	defer db.Close()
+	c := newClient(t, vkey)
+	url := serve(t, db)
+
+	// enough records for full and partial tiles
+	add(t, db, 300)
+	for _, v := range []string{"v1.0.0", "v1.0.299", "v1.2.3"} {
+		m := module.Version{Path: "vanity.test/m", Version: v}
+		lines, err := c.lookup(url, m)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", m, err)
+		}
+		// only the zip line is for the version itself
+		want, _, _ := goSum(context.Background(), m)
+		if len(lines) != 1 || !strings.HasPrefix(string(want), lines[0]+"\n") {
+			t.Errorf("lookup %s = %q, want first line of %q", m, lines, want)
+		}
+	}
+
+	_, err := c.lookup(url, module.Version{Path: "vanity.test/m", Version: "v2.0.0"})
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("lookup of unknown version = %v, want 404", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	keyFile, vkey := newKey(t)
+	c := newClient(t, vkey)
+
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, dir string)
+	}{
+		{"clean", func(t *testing.T, dir string) {}},
+		{"truncated record", func(t *testing.T, dir string) {
+			// a length prefix and part of the record
+			f, err := os.OpenFile(filepath.Join(dir, "records"), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			_, err = f.Write([]byte{0, 0, 0, 100, 'v', 'a'})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"missing hashes", func(t *testing.T, dir string) {
+			fn := filepath.Join(dir, "hashes")
+			fi, err := os.Stat(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the last few records, and part of a hash
+			err = os.Truncate(fn, fi.Size()-200)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"no hashes", func(t *testing.T, dir string) {
+			err := os.Truncate(filepath.Join(dir, "hashes"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := open(t, dir, keyFile)
+			add(t, db, 20)
+			// the client remembers the signed tree head
+			m := module.Version{Path: "vanity.test/m", Version: "v1.0.19"}
+			_, err := c.lookup(serve(t, db), m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			tt.damage(t, dir)
+
+			db = open(t, dir, keyFile)
+			defer db.Close()
+			if len(db.texts) != 20 {
+				t.Fatalf("reopened with %d records, want 20", len(db.texts))
+			}
+			add(t, db, 5)
+			// the new tree has to be consistent with the one from before
+			url := serve(t, db)
+			for _, v := range []string{"v1.0.0", "v1.0.19", "v1.0.24"} {
+				m := module.Version{Path: "vanity.test/m", Version: v}
+				_, err = c.lookup(url, m)
+				if err != nil {
+					t.Fatalf("lookup %s after restart: %v", m, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFailedAppend(t *testing.T) {
+	keyFile, vkey := newKey(t)
+	c := newClient(t, vkey)
+	dir := t.TempDir()
+	db := open(t, dir, keyFile)
+	add(t, db, 10)
+	_, err := c.lookup(serve(t, db), module.Version{Path: "vanity.test/m", Version: "v1.0.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// storing hashes fails after the record is written,
+	// and the hashes file can't be truncated either
+	db.hashes.Close()
+	ctx := context.Background()
+	_, err = db.Add(ctx, module.Version{Path: "vanity.test/m", Version: "v1.1.0"})
+	if err == nil {
+		t.Fatal("Add with closed hashes file succeeded")
+	}
+	_, err = db.Add(ctx, module.Version{Path: "vanity.test/m", Version: "v1.1.1"})
+	if err == nil {
+		t.Fatal("Add after failed undo succeeded")
+	}
+	db.records.Close()
+
+	db = open(t, dir, keyFile)
+	defer db.Close()
+	if len(db.texts) != 10 {
+		t.Fatalf("reopened with %d records, want 10", len(db.texts))
+	}
+	_, err = c.lookup(serve(t, db), module.Version{Path: "vanity.test/m", Version: "v1.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,21 +2,42 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"html/template"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
+	"go.seankhliao.com/vanity/internal/gitrepo"
+	"go.seankhliao.com/vanity/internal/goproxy"
+	"go.seankhliao.com/vanity/internal/mirror"
+	"go.seankhliao.com/vanity/internal/proxycache"
+	"go.seankhliao.com/vanity/internal/registry"
 	"go.seankhliao.com/vanity/internal/serve"
+	"go.seankhliao.com/vanity/internal/sumdb"
+	"golang.org/x/mod/module"
 	"k8s.io/klog/v2"
 )
 
 //go:generate go run generate.go template.gohtml
 
 const (
-	name        = "go.seankhliao.com/vanity"
-	redirectURL = "https://seankhliao.com/"
+	// goGetTmplStr is the minimal document for the go command
+	goGetTmplStr = `<!DOCTYPE html>
+<meta name="go-import" content="{{ .GoImport }}">
+{{- with .GoSource }}
+<meta name="go-source" content="{{ . }}">
+{{- end }}
+`
+
+	// mirrorPrefix is where mirrored repositories are served on every host,
+	// import paths can't start with a dot so it doesn't hide any module
+	mirrorPrefix = "/.mirror"
 )
 
 func main() {
@@ -25,29 +46,411 @@ func main() {
 
 type Server struct {
 	// config
-	tmpl *template.Template
+	config    string
+	sumdbDir  string
+	sumdbKey  string
+	sumdbSync time.Duration
+	upstream  string
+	cacheDir  string
+	cacheSize int64
+	mirrorDir string
+	mirrorInt time.Duration
+	listInt   time.Duration
+
+	// templates by host
+	tmpls     map[string]*template.Template
+	gogetTmpl *template.Template
+	reg       *registry.Registry
+	cache     *proxycache.Cache
+	mirror    *mirror.Mirror
+	listings  *goproxy.Listings
+
+	// metrics
+	hits       *serve.CounterVec
+	tmplErrors *serve.CounterVec
 }
 
-func (s *Server) InitFlags(fs *flag.FlagSet) {}
+func (s *Server) InitFlags(fs *flag.FlagSet) {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	fs.StringVar(&s.config, "config", "vanity.json", "module registry config file")
+	fs.StringVar(&s.sumdbKey, "sumdb-key", "", "checksum database note signer key file, enables the checksum database")
+	fs.StringVar(&s.sumdbDir, "sumdb-dir", "sumdb", "checksum database storage directory")
+	fs.DurationVar(&s.sumdbSync, "sumdb-sync", 15*time.Minute, "interval to record new tagged versions in the checksum database")
+	fs.StringVar(&s.upstream, "proxy-upstream", "", "upstream module proxy for other modules, enables the proxy cache")
+	fs.StringVar(&s.cacheDir, "proxy-cache-dir", "proxycache", "module proxy cache storage directory")
+	fs.Int64Var(&s.cacheSize, "proxy-cache-size", 10<<30, "module proxy cache size limit in bytes")
+	fs.StringVar(&s.mirrorDir, "mirror-dir", "", "directory to mirror git repositories in, enables mirroring")
+	fs.DurationVar(&s.mirrorInt, "mirror-sync", time.Minute, "interval to sync mirrors and check their origins")
+	fs.DurationVar(&s.listInt, "versions-refresh", time.Minute, "interval to check local repositories for new tags to list on pages")
+}
 
 func (s *Server) Setup(ctx context.Context, c *serve.Components) error {
-	s.tmpl = template.Must(template.New("page").Parse(tmplStr))
+	var err error
+	s.reg, err = registry.Load(s.config)
+	if err != nil {
+		return err
+	}
+	base := template.Must(template.New("page").Parse(tmplStr))
+	s.tmpls = make(map[string]*template.Template, len(s.reg.Hosts))
+	for _, h := range s.reg.Hosts {
+		s.tmpls[h.Name] = base
+		if h.Template == "" {
+			continue
+		}
+		t, err := template.Must(base.Clone()).ParseFiles(h.Template)
+		if err != nil {
+			return fmt.Errorf("host %s: parse template: %w", h.Name, err)
+		}
+		s.tmpls[h.Name] = t
+	}
+	s.gogetTmpl = template.Must(template.New("goget").Parse(goGetTmplStr))
+	for _, h := range s.reg.Hosts {
+		c.Hosts = append(c.Hosts, h.Name)
+	}
+
+	s.hits = c.Metrics.Counter("vanity_module_requests_total", "Requests for module paths, by module and client: go-get, browser or json.", "module", "client")
+	s.tmplErrors = c.Metrics.Counter("vanity_template_errors_total", "Template render errors, by template.", "template")
+	for _, t := range []string{"module", "index", "goget"} {
+		s.tmplErrors.Add(0, t)
+	}
+
+	if s.sumdbKey != "" {
+		db, err := sumdb.Open(s.sumdbDir, s.sumdbKey, s.goSum)
+		if err != nil {
+			return fmt.Errorf("open sumdb: %w", err)
+		}
+		prefix := "/sumdb/" + db.Name()
+		c.Mux.Handle(prefix+"/", http.StripPrefix(prefix, db.Handler()))
+		go s.syncSumDB(ctx, db)
+	}
+
+	if s.upstream != "" {
+		s.cache, err = proxycache.Open(s.cacheDir, s.upstream, s.cacheSize)
+		if err != nil {
+			return fmt.Errorf("open proxy cache: %w", err)
+		}
+		go s.cache.Run(ctx)
+	}
+
+	if s.mirrorDir != "" {
+		s.mirror = mirror.New(s.mirrorDir, s.mirrorInt)
+		for _, h := range s.reg.Hosts {
+			for _, m := range h.Modules {
+				if m.VCS != "git" || m.Proxy {
+					continue
+				}
+				_, err = s.mirror.Add(m.Repo)
+				if err != nil {
+					return fmt.Errorf("mirror %s: %w", m.Path, err)
+				}
+			}
+		}
+		handler, err := s.mirror.Handler(mirrorPrefix)
+		if err != nil {
+			return fmt.Errorf("serve mirrors: %w", err)
+		}
+		c.Mux.Handle(mirrorPrefix+"/", handler)
+		go s.mirror.Run(ctx)
+	}
+
+	// listed before serving, so pages don't start out without versions
+	s.listings = goproxy.NewListings(s.listInt)
+	for _, h := range s.reg.Hosts {
+		for _, m := range h.Modules {
+			if m.Local != "" {
+				s.listings.Add(m.Path, m.Subdir, m.Local)
+			}
+		}
+	}
+	s.listings.Refresh(ctx)
+	go s.listings.Run(ctx)
+
+	c.Health.AddReadyCheck("local repos", s.checkLocal)
+
 	c.Mux.Handle("/", s)
 	return nil
 }
 
+// checkLocal checks that the local repositories are still there,
+// they may be on a volume that went away
+func (s *Server) checkLocal(ctx context.Context) error {
+	for _, h := range s.reg.Hosts {
+		for _, m := range h.Modules {
+			if m.Local == "" {
+				continue
+			}
+			_, err := os.Stat(m.Local)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// goSum finds the go.sum lines of our modules for the checksum database
+func (s *Server) goSum(ctx context.Context, mv module.Version) ([]byte, bool, error) {
+	m, ok, err := s.localModule(ctx, mv.Path)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return m.GoSum(ctx, mv.Version)
+}
+
+// syncSumDB records all tagged versions of our modules
+// in the checksum database, until ctx is done
+func (s *Server) syncSumDB(ctx context.Context, db *sumdb.DB) {
+	t := time.NewTicker(s.sumdbSync)
+	defer t.Stop()
+	for {
+		for _, h := range s.reg.Hosts {
+			for _, rm := range h.Modules {
+				if rm.Local == "" {
+					continue
+				}
+				m, _, err := s.localModule(ctx, rm.Path)
+				if err != nil {
+					klog.ErrorS(err, "sumdb sync", "module", rm.Path)
+					continue
+				}
+				vs, err := m.Versions(ctx)
+				if err != nil {
+					klog.ErrorS(err, "sumdb sync", "module", rm.Path)
+					continue
+				}
+				for _, v := range vs {
+					_, err = db.Add(ctx, module.Version{Path: m.Path, Version: v})
+					if err != nil {
+						klog.ErrorS(err, "sumdb sync", "module", m.Path, "version", v)
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// localModule finds a module with a local repository by its exact path
+func (s *Server) localModule(ctx context.Context, p string) (goproxy.Module, bool, error) {
+	for _, h := range s.reg.Hosts {
+		m, ok := h.Lookup(p)
+		if !ok || m.Path != p || m.Local == "" {
+			continue
+		}
+		repo, err := gitrepo.Open(ctx, m.Local)
+		if err != nil {
+			return goproxy.Module{}, false, err
+		}
+		return goproxy.Module{
+			Path:   m.Path,
+			Subdir: m.Subdir,
+			Repo:   repo,
+		}, true, nil
+	}
+	return goproxy.Module{}, false, nil
+}
+
 func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, ok := s.reg.Host(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
 	// filter paths
 	if r.URL.Path == "/" {
-		http.Redirect(w, r, redirectURL, http.StatusFound)
+		if h.Redirect != "" {
+			http.Redirect(w, r, h.Redirect, http.StatusFound)
+			return
+		}
+		serve.SetRoute(r, "index")
+		s.index(w, r, h)
+		return
+	}
+
+	if modPath, req, ok := goproxy.Split(r.URL.Path); ok {
+		s.proxy(w, r, h, modPath, req)
 		return
 	}
 
-	repo := strings.Split(r.URL.Path, "/")[1]
-	err := s.tmpl.Execute(w, map[string]string{"Repo": repo})
+	// validate before anything reaches the template
+	p := h.Name + strings.TrimSuffix(r.URL.Path, "/")
+	err := module.CheckImportPath(p)
 	if err != nil {
+		http.Error(w, "invalid import path", http.StatusBadRequest)
+		return
+	}
+
+	m, ok := h.Lookup(p)
+	if mv, moved := h.LookupMoved(p); moved && (!ok || m.IsFallback() || len(mv.Path) > len(m.Path)) {
+		serve.SetRoute(r, "moved")
+		s.moved(w, r, mv, p)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// any path can match a fallback module, keep them out of the metric labels
+	label := m.Path
+	if m.IsFallback() {
+		label = h.Name + "/*"
+	}
+
+	if r.FormValue("go-get") == "1" {
+		goImport, maxAge := m.GoImport(), 3600
+		if s.mirror != nil && m.VCS == "git" && !m.Proxy {
+			if name, ok := s.mirror.Failover(m.Repo); ok {
+				// switch back soon after the origin recovers
+				goImport, maxAge = m.GoImportRepo("https://"+h.Name+mirrorPrefix+"/"+name), 60
+			}
+		}
+		serve.SetRoute(r, "go-get")
+		s.hits.Inc(label, "go-get")
+		s.goGet(w, r, goImport, m.GoSource(), maxAge)
+		return
+	}
+
+	var versions *goproxy.Listing
+	if l, ok := s.listings.Get(m.Path); ok {
+		versions = &l
+	}
+	if r.FormValue("format") == "json" {
+		serve.SetRoute(r, "versions")
+		s.hits.Inc(label, "json")
+		if versions == nil {
+			http.Error(w, "versions not available", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+		return
+	}
+
+	serve.SetRoute(r, "module")
+	s.hits.Inc(label, "browser")
+	if u := m.DocsURLFor(p); h.DocsRedirect && u != "" {
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	err = s.tmpls[h.Name].ExecuteTemplate(w, "module", map[string]interface{}{
+		"Host":     h,
+		"Repo":     strings.TrimPrefix(m.Path, h.Name+"/"),
+		"Module":   m,
+		"Versions": versions,
+	})
+	if err != nil {
+		s.tmplErrors.Inc("module")
 		klog.ErrorS(err, "exec", "path", r.URL.Path)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+func (s Server) goGet(w http.ResponseWriter, r *http.Request, goImport, goSource string, maxAge int) {
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	err := s.gogetTmpl.Execute(w, map[string]string{
+		"GoImport": goImport,
+		"GoSource": goSource,
+	})
+	if err != nil {
+		s.tmplErrors.Inc("goget")
+		klog.ErrorS(err, "exec goget", "path", r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// moved answers for import paths under a moved module:
+// the go command gets the new repository or an error,
+// browsers are sent to the new path
+func (s Server) moved(w http.ResponseWriter, r *http.Request, mv *registry.Move, p string) {
+	if r.FormValue("go-get") == "1" {
+		if goImport, ok := mv.GoImport(); ok {
+			s.goGet(w, r, goImport, "", 3600)
+			return
+		}
+		// the go command shows plain text error responses to the user
+		http.Error(w, mv.Message(), http.StatusGone)
+		return
+	}
+	if u := mv.URL(p); u != "" {
+		http.Redirect(w, r, u, http.StatusMovedPermanently)
+		return
+	}
+	http.Error(w, mv.Message(), http.StatusGone)
+}
+
+// proxy serves the module proxy protocol for modules with a local repository,
+// using the host as the GOPROXY base url.
+// Other modules go through the cache of the upstream proxy if there is one.
+func (s Server) proxy(w http.ResponseWriter, r *http.Request, h *registry.Host, modPath, req string) {
+	p, err := module.UnescapePath(modPath)
+	if err != nil {
+		http.Error(w, "invalid module path", http.StatusBadRequest)
+		return
+	}
+	if rm, ok := h.Lookup(p); !ok || rm.Path != p || rm.Local == "" {
+		if s.cache != nil {
+			serve.SetRoute(r, "proxy-cache")
+			s.cache.Serve(w, r, modPath, req)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	m, _, err := s.localModule(r.Context(), p)
+	if err != nil {
+		klog.ErrorS(err, "open repo", "module", p)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	serve.SetRoute(r, "proxy")
+	goproxy.Serve(w, r, m, req)
+}
+
+type indexEntry struct {
+	Module     *registry.Module
+	Link       string
+	Latest     *goproxy.Release
+	Deprecated bool
+}
+
+func (s Server) index(w http.ResponseWriter, r *http.Request, h *registry.Host) {
+	entries := make([]indexEntry, 0, len(h.Modules))
+	for _, m := range h.Modules {
+		e := indexEntry{
+			Module: m,
+			Link:   strings.TrimPrefix(m.Path, h.Name),
+		}
+		if l, ok := s.listings.Get(m.Path); ok {
+			e.Latest, e.Deprecated = l.Latest, l.Deprecated
+			if e.Latest == nil {
+				e.Latest = l.LatestPrerelease
+			}
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Module.Path < entries[j].Module.Path
+	})
+
+	err := s.tmpls[h.Name].ExecuteTemplate(w, "index", map[string]interface{}{
+		"Host":    h,
+		"Modules": entries,
+	})
+	if err != nil {
+		s.tmplErrors.Inc("index")
+		klog.ErrorS(err, "exec index")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
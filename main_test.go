@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.seankhliao.com/vanity/internal/serve"
+)
+
+// newServer sets up the service with a config, without listening
+func newServer(t *testing.T, config string) http.Handler {
+	t.Helper()
+	h, err := setup(t, &Server{listInt: time.Hour}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// setup sets up s with a config
+func setup(t *testing.T, s *Server, config string) (http.Handler, error) {
+	t.Helper()
+	s.config = filepath.Join(t.TempDir(), "vanity.json")
+	err := ioutil.WriteFile(s.config, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := &serve.Components{
+		Mux:     http.NewServeMux(),
+		Admin:   http.NewServeMux(),
+		Metrics: &serve.Metrics{},
+		Health:  &serve.Health{},
+	}
+	return c.Mux, s.Setup(ctx, c)
+}
+
+func get(h http.Handler, target string) (int, string) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Host = "vanity.test"
+	h.ServeHTTP(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestInvalidPath(t *testing.T) {
+	h := newServer(t, `{
+  "host": "vanity.test",
+  "repo_prefix": "https://git.example.com/",
+  "modules": [{ "path": "vanity.test/m", "repo": "https://git.example.com/m" }]
+}`)
+	for _, target := range []string{
+		"/%3Cscript%3Ealert(1)%3C/script%3E",
+		"/%3Cscript%3E?go-get=1",
+		`/a"onload=alert(1)`,
+		`/m/a"onload=alert(1)?go-get=1`,
+		"/m/%3Cb%3E",
+	} {
+		code, body := get(h, target)
+		if code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, code)
+		}
+		if strings.Contains(body, "<") || strings.Contains(body, `"on`) {
+			t.Errorf("GET %s reflected the path: %q", target, body)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	h := newServer(t, `{
+  "host": "vanity.test",
+  "branding": {
+    "links": [{ "name": "<i>home</i>", "url": "javascript:alert(1)" }]
+  },
+  "modules": [
+    {
+      "path": "vanity.test/m",
+      "repo": "https://git.example.com/m\"><script>alert(1)</script>",
+      "description": "<script>alert(1)</script> \"quoted\" & <b>bold</b>"
+    }
+  ]
+}`)
+	for _, target := range []string{"/", "/m", "/m/sub", "/m?go-get=1"} {
+		code, body := get(h, target)
+		if code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", target, code)
+			continue
+		}
+		for _, raw := range []string{"<script>alert", "<b>bold", "<i>home", `"><script`, "javascript:alert"} {
+			if strings.Contains(body, raw) {
+				t.Errorf("GET %s: unescaped %q in\n%s", target, raw, body)
+			}
+		}
+	}
+
+	// still there, escaped
+	_, body := get(h, "/m")
+	if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("module page without the escaped description:\n%s", body)
+	}
+	_, body = get(h, "/")
+	if !strings.Contains(body, "&lt;b&gt;bold&lt;/b&gt;") {
+		t.Errorf("index page without the escaped description:\n%s", body)
+	}
+	_, body = get(h, "/m?go-get=1")
+	if !strings.Contains(body, `content="vanity.test/m git https://git.example.com/m&#34;&gt;&lt;script&gt;`) {
+		t.Errorf("go-get page without the escaped repo:\n%s", body)
+	}
+}
+
+func TestMirrorPrefix(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("no git: %v", err)
+	}
+	// can't be created, so the syncs in the background
+	// fail without writing anything and nothing is ever mirrored
+	mirrorDir := filepath.Join(os.DevNull, "mirror")
+	s := &Server{listInt: time.Hour, mirrorDir: mirrorDir, mirrorInt: time.Hour}
+	h, err := setup(t, s, `{
+  "host": "vanity.test",
+  "modules": [{ "path": "vanity.test/git", "repo": "https://127.0.0.1:1/git" }]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mirrors don't hide modules
+	code, body := get(h, "/git?go-get=1")
+	if code != http.StatusOK || !strings.Contains(body, `content="vanity.test/git git https://127.0.0.1:1/git"`) {
+		t.Errorf("GET /git?go-get=1 = %d\n%s", code, body)
+	}
+	code, _ = get(h, "/.mirror/127.0.0.1/git.git/info/refs?service=git-upload-pack")
+	if code != http.StatusNotFound {
+		t.Errorf("mirror that was never cloned = %d, want 404", code)
+	}
+
+	// local repositories aren't mirrored
+	s = &Server{listInt: time.Hour, mirrorDir: mirrorDir, mirrorInt: time.Hour}
+	_, err = setup(t, s, `{
+  "host": "vanity.test",
+  "modules": [{ "path": "vanity.test/m", "repo": "/srv/git/m" }]
+}`)
+	if err == nil || !strings.Contains(err.Error(), "not a remote repository") {
+		t.Errorf("Setup mirroring a local repository = %v, want error", err)
+	}
+}
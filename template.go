@@ -2,33 +2,129 @@
 package main
 
 const (
-        tmplStr = `<!DOCTYPE html>
+        tmplStr = `{{ define "module" -}}
+<!DOCTYPE html>
 <html lang="en">
   <meta charset="utf-8" />
   <meta name="viewport" content="width=device-width,minimum-scale=1,initial-scale=1" />
-  <meta
-    name="go-import"
-    content="go.seankhliao.com/{{ .Repo }}
-        git https://github.com/seankhliao/{{ .Repo }}"
-  />
-  <meta
-    name="go-source"
-    content="go.seankhliao.com/{{ .Repo }}
-        https://github.com/seankhliao/{{ .Repo }}
-        https://github.com/seankhliao/{{ .Repo }}/tree/master{/dir}
-        https://github.com/seankhliao/{{ .Repo }}/blob/master{/dir}/{file}#L{line}"
-  />
-  <meta http-equiv="refresh" content="5;url=https://godoc.org/go.seankhliao.com/{{ .Repo }}" />
-  <title>go.seankhliao.com/{{ .Repo }}</title>
-  <link rel="canonical" href="https://seankhliao.com" />
+  <meta name="go-import" content="{{ .Module.GoImport }}" />
+  {{- with .Module.GoSource }}
+  <meta name="go-source" content="{{ . }}" />
+  {{- end }}
+  {{- with .Module.DocsRefreshMeta }}
+  <meta http-equiv="refresh" content="{{ . }}" />
+  {{- end }}
+  <title>{{ .Module.Path }}</title>
+  <meta name="description" content="{{ .Module.Description }}" />
+  {{ template "head" .Host }}
+</head>
+<body>
+  <h3><em>{{ .Host.Name }}/</em>{{ .Repo }}</h3>
+  {{- with .Versions }}{{ if .Deprecated }}
+  <p class="banner"><em>deprecated:</em> {{ .Deprecation }}</p>
+  {{- end }}{{ end }}
+  {{ with .Module.Description }}
+  <p>{{ . }}</p>
+  {{ end }}
+
+  <p><em>source:</em>
+  <a href="{{ .Module.SourceURL }}">{{ .Module.Repo }}</a>
+  {{ if .Module.IsProxy }}(module proxy){{ else }}({{ .Module.VCS }}, {{ .Module.Branch }}){{ end }}
+  </p>
+  {{- with .Module }}{{ if .DocsURL }}
+  <p><em>docs:</em>
+  <a href="{{ .DocsURL }}">{{ .DocsSite }}</a>
+  </p>
+  {{- end }}{{ end }}
+
+  {{- with .Versions }}
+  <h5>versions</h5>
+  <p><em>latest:</em>
+  {{ with .Latest }}{{ .Version }} <time datetime="{{ .Time.Format "2006-01-02" }}">{{ .Time.Format "2006-01-02" }}</time>{{ else }}no release{{ end }}
+  {{- with .LatestPrerelease }}
+  <em>prerelease:</em>
+  {{ .Version }} <time datetime="{{ .Time.Format "2006-01-02" }}">{{ .Time.Format "2006-01-02" }}</time>
+  {{- end }}
+  </p>
+  {{- with .Versions }}
+  <table>
+    <thead>
+      <tr>
+        <th>version</th>
+        <th>date</th>
+        <th>retracted</th>
+      </tr>
+    </thead>
+    <tbody>
+      {{- range . }}
+      <tr{{ if .Retracted }} class="retracted"{{ end }}>
+        <td>{{ .Version }}</td>
+        <td><time datetime="{{ .Time.Format "2006-01-02" }}">{{ .Time.Format "2006-01-02" }}</time></td>
+        <td>{{ if .Retracted }}retracted{{ with .Rationale }}: {{ . }}{{ end }}{{ end }}</td>
+      </tr>
+      {{- end }}
+    </tbody>
+  </table>
+  {{- end }}
+  {{- end }}
+
+  {{ template "footer" .Host }}
+</body>
+</html>
+{{- end }}
+
+{{ define "index" -}}
+<!DOCTYPE html>
+<html lang="en">
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width,minimum-scale=1,initial-scale=1" />
+  <title>{{ .Host.Name }}</title>
+  <meta name="description" content="Go modules under {{ .Host.Name }}" />
+  {{ template "head" .Host }}
+</head>
+<body>
+  <h3><em>{{ .Host.Name }}</em></h3>
+
+  <table>
+    <thead>
+      <tr>
+        <th>module</th>
+        <th>latest</th>
+        <th>description</th>
+        <th>source</th>
+        <th>docs</th>
+      </tr>
+    </thead>
+    <tbody>
+      {{- range .Modules }}
+      <tr>
+        <td><a href="{{ .Link }}">{{ .Module.Path }}</a>{{ if .Deprecated }} (deprecated){{ end }}</td>
+        <td>{{ with .Latest }}<time datetime="{{ .Time.Format "2006-01-02" }}">{{ .Version }}</time>{{ end }}</td>
+        <td>{{ .Module.Description }}</td>
+        <td><a href="{{ .Module.SourceURL }}">{{ .Module.VCS }}</a></td>
+        <td>{{ with .Module }}{{ if .DocsURL }}<a href="{{ .DocsURL }}">{{ .DocsSite }}</a>{{ end }}{{ end }}</td>
+      </tr>
+      {{- end }}
+    </tbody>
+  </table>
+
+  {{ template "footer" .Host }}
+</body>
+</html>
+{{- end }}
+
+{{ define "head" -}}
+  {{- with .Branding.Home }}
+  <link rel="canonical" href="{{ . }}" />
+  {{- end }}
   <link rel="manifest" href="/manifest.json" />
 
   <meta name="theme-color" content="#000000" />
-  <meta name="description" content="" />
 
-  <link rel="icon" type="image/png" sizes="512x512" href="https://seankhliao.com/icon-512.png" />
-  <link rel="apple-touch-icon" href="https://seankhliao.com/icon-512.png" />
-  <link rel="shortcut icon" href="https://seankhliao.com/favicon.ico" />
+  {{- with .Branding.Icon }}
+  <link rel="icon" type="image/png" sizes="512x512" href="{{ . }}" />
+  <link rel="apple-touch-icon" href="{{ . }}" />
+  {{- end }}
 
   <style nonce="deadbeef1">
 * {
@@ -264,6 +360,15 @@ tr:nth-child(5n) td {
 tbody tr:hover {
   background: #404040;
 }
+tr.retracted td {
+  color: #999;
+  text-decoration: line-through;
+}
+
+.banner {
+  border-left: 1ch solid #a06be0;
+  padding: 0.25em 1em;
+}
 
 /* ===== gtm ===== */
 noscript iframe {
@@ -293,28 +398,15 @@ ul > li:before {
 content: "";
 }
   </style>
-</head>
-<body>
-  <h3><em>go.seankhliao.com/</em>{{ .Repo }}</h3>
+{{- end }}
 
-  <p><em>source:</em>
-  <a href="https://github.com/seankhliao/{{ .Repo }}">github</a>
-  </p>
-  <p><em>docs:</em>
-  <a href="https://godoc.org/go.seankhliao.com/{{ .Repo }}">godoc.org</a>
-  <a href="https://pkg.go.dev/go.seankhliao.com/{{ .Repo }}">pkg.go.dev</a>
-  </p>
-
-  <footer>
-    <a href="https://seankhliao.com/">home</a>
-    |
-    <a href="https://seankhliao.com/blog/">blog</a>
-    |
-    <a href="https://github.com/seankhliao">github</a>
-    |
-    <a href="https://seankhliao.com/terms/">terms</a>
+{{ define "footer" -}}
+<footer>
+    {{- range $i, $l := .Branding.Links }}
+    {{ if $i }}|{{ end }}
+    <a href="{{ $l.URL }}">{{ $l.Name }}</a>
+    {{- end }}
   </footer>
-</body>
-</html>
+{{- end }}
 `
 )